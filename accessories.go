@@ -0,0 +1,125 @@
+package main
+
+import "errors"
+
+const (
+	accessoryVentilator  = 0x01
+	accessoryHumidifier  = 0x02
+	accessoryUVLamp      = 0x04
+	accessoryAirPurifier = 0x08
+)
+
+type APIAccessory struct {
+	Installed     bool   `json:"installed"`
+	Active        bool   `json:"active"`
+	RuntimeHours  uint16 `json:"runtimeHours"`
+	LifeRemaining uint8  `json:"lifeRemaining"` // percent
+}
+
+type APIVentilator struct {
+	APIAccessory
+	Type  string `json:"type"`
+	Level string `json:"level"`
+}
+
+type APIHumidifier struct {
+	APIAccessory
+	Enabled bool `json:"enabled"`
+}
+
+type APIAccessories struct {
+	Ventilator  APIVentilator `json:"ventilator"`
+	Humidifier  APIHumidifier `json:"humidifier"`
+	UVLamp      APIAccessory  `json:"uvLamp"`
+	AirPurifier APIAccessory  `json:"airPurifier"`
+}
+
+type APIAccessoriesUpdate struct {
+	VentilationLevel  *string `json:"ventilationLevel"`
+	HumidifierEnabled *bool   `json:"humidifierEnabled"`
+}
+
+func (params TStatAccessories) accessory(bit uint8, runtime uint16, life uint8) APIAccessory {
+	return APIAccessory{
+		Installed:     params.Installed&bit != 0,
+		Active:        params.Active&bit != 0,
+		RuntimeHours:  runtime,
+		LifeRemaining: life,
+	}
+}
+
+func (params TStatAccessories) toAPI() APIAccessories {
+	return APIAccessories{
+		Ventilator: APIVentilator{
+			APIAccessory: params.accessory(accessoryVentilator, params.VentilatorRuntime, params.VentilatorLife),
+			Type:         rawVentilatorTypeToString(params.VentilatorType),
+			Level:        rawVentilationLevelToString(params.VentilationLevel),
+		},
+		Humidifier: APIHumidifier{
+			APIAccessory: params.accessory(accessoryHumidifier, params.HumidifierRuntime, params.HumidifierLife),
+			Enabled:      params.HumidifierEnabled == 1,
+		},
+		UVLamp:      params.accessory(accessoryUVLamp, params.UVLampRuntime, params.UVLampLife),
+		AirPurifier: params.accessory(accessoryAirPurifier, params.AirPurifierRuntime, params.AirPurifierLife),
+	}
+}
+
+// fromAPI copies an update into params and returns the write flags covering
+// it.  Accessories that aren't installed can't be controlled.
+func (params *TStatAccessories) fromAPI(update *APIAccessoriesUpdate) (byte, error) {
+	flags := byte(0)
+
+	if update.VentilationLevel != nil {
+		if params.Installed&accessoryVentilator == 0 {
+			return 0, errors.New("no ventilator is installed")
+		}
+		level, ok := stringVentilationLevelToRaw(*update.VentilationLevel)
+		if !ok {
+			return 0, errors.New("invalid ventilation level: " + *update.VentilationLevel)
+		}
+		params.VentilationLevel = level
+		flags |= 0x01
+	}
+
+	if update.HumidifierEnabled != nil {
+		if params.Installed&accessoryHumidifier == 0 {
+			return 0, errors.New("no humidifier is installed")
+		}
+		if *update.HumidifierEnabled {
+			params.HumidifierEnabled = 1
+		} else {
+			params.HumidifierEnabled = 0
+		}
+		flags |= 0x02
+	}
+
+	return flags, nil
+}
+
+func getAccessories() (*APIAccessories, bool) {
+	params := TStatAccessories{}
+	ok := infinity.ReadTable(devTSTAT, &params)
+	if !ok {
+		return nil, false
+	}
+
+	api := params.toAPI()
+	return &api, true
+}
+
+func putAccessories(update *APIAccessoriesUpdate) (bool, error) {
+	params := TStatAccessories{}
+	if !infinity.ReadTable(devTSTAT, &params) {
+		return false, nil
+	}
+
+	flags, err := params.fromAPI(update)
+	if err != nil {
+		return false, err
+	}
+	if flags == 0 {
+		return true, nil
+	}
+
+	return writeTable(devTSTAT, params, flags)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// readGroup coalesces concurrent reads of the same thing into a single bus
+// transaction; callers arriving while a read is in flight share its result.
+type readGroup struct {
+	mutex sync.Mutex
+	calls map[string]*readCall
+}
+
+type readCall struct {
+	done  chan struct{}
+	value interface{}
+	ok    bool
+}
+
+// Keys include the priority so an API read doesn't have to wait for a poll
+// to get through the action queue; identical reads waiting in the queue
+// are merged there instead.
+var busReads = &readGroup{calls: make(map[string]*readCall)}
+
+func (g *readGroup) do(key string, read func() (interface{}, bool)) (interface{}, bool) {
+	g.mutex.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-call.done
+		return call.value, call.ok
+	}
+	call := &readCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.value, call.ok = read()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(call.done)
+
+	return call.value, call.ok
+}
+
+// defaultMaxAge is how old cached data may be when a request doesn't say:
+// anything that isn't stale yet.
+func defaultMaxAge(section string) time.Duration {
+	if maxAge := state.sectionMaxAge(section); maxAge > 0 {
+		return maxAge
+	}
+	return math.MaxInt64
+}
+
+// refreshZoneTables reads the zone tables from the thermostat and stores
+// them in the system state.
+func refreshZoneTables(priority actionPriority) (*zoneTables, bool) {
+	t, ok := busReads.do(fmt.Sprintf("zones/%s", priority), func() (interface{}, bool) {
+		t, ok := readZoneTables(priority)
+		if !ok {
+			return nil, false
+		}
+
+		zones := t.zoneConfigs()
+
+		state.mutex.Lock()
+		state.tables = t
+		state.mutex.Unlock()
+
+		setSection(state, &state.zones, zones, sourcePolled)
+		if c1, ok := zones["1"]; ok {
+			setSection(state, &state.tstat, c1, sourcePolled)
+		}
+		return t, true
+	})
+	if !ok {
+		return nil, false
+	}
+	return t.(*zoneTables), true
+}
+
+// cachedZoneTables returns the zone tables if they were read within maxAge,
+// otherwise reads them again.
+func cachedZoneTables(maxAge time.Duration) (*zoneTables, bool) {
+	state.mutex.RLock()
+	t, fresh := state.tables, state.zones.fresh(maxAge)
+	state.mutex.RUnlock()
+
+	if fresh && t != nil {
+		return t, true
+	}
+	return refreshZoneTables(priorityRead)
+}
+
+// refreshSettings reads the thermostat settings and stores them in the
+// system state.
+func refreshSettings(priority actionPriority) bool {
+	_, ok := busReads.do(fmt.Sprintf("settings/%s", priority), func() (interface{}, bool) {
+		settings, ok := getTstatSettings(priority)
+		if !ok {
+			return nil, false
+		}
+		setSection(state, &state.settings, *settings, sourcePolled)
+		return settings, true
+	})
+	return ok
+}
+
+func cachedSettings(maxAge time.Duration) (APITStatSettings, bool) {
+	return cachedSection(state, &state.settings, maxAge, func() bool {
+		return refreshSettings(priorityRead)
+	})
+}
+
+// refreshSchedule reads the schedules of every configured zone and stores
+// them in the system state.
+func refreshSchedule(priority actionPriority) bool {
+	_, ok := busReads.do(fmt.Sprintf("schedule/%s", priority), func() (interface{}, bool) {
+		sched, ok := getSchedule(priority)
+		if !ok {
+			return nil, false
+		}
+		setSection(state, &state.schedule, *sched, sourcePolled)
+		return sched, true
+	})
+	return ok
+}
+
+func cachedSchedule(maxAge time.Duration) (APISchedule, bool) {
+	return cachedSection(state, &state.schedule, maxAge, func() bool {
+		return refreshSchedule(priorityRead)
+	})
+}
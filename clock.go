@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Clock synchronisation settings, set from the command line.  A zero
+// interval disables automatic synchronisation.
+var (
+	clockSyncInterval  time.Duration
+	clockSyncThreshold = 2 * time.Minute
+)
+
+type APITStatTime struct {
+	TStatTime string `json:"tstatTime"`
+	HostTime  string `json:"hostTime"`
+	DayOfWeek string `json:"dayOfWeek"`
+	Drift     int64  `json:"driftSeconds"`
+	InSync    bool   `json:"inSync"`
+}
+
+const clockLayout = "2006-01-02T15:04"
+
+func (params TStatDateTime) toTime() time.Time {
+	return time.Date(2000+int(params.Year), time.Month(params.Month), int(params.Day),
+		int(params.Hour), int(params.Minute), 0, 0, time.Local)
+}
+
+func tstatDateTime(t time.Time) TStatDateTime {
+	return TStatDateTime{
+		Hour:      uint8(t.Hour()),
+		Minute:    uint8(t.Minute()),
+		DayOfWeek: uint8(t.Weekday()),
+		Day:       uint8(t.Day()),
+		Month:     uint8(t.Month()),
+		Year:      uint8(t.Year() - 2000),
+	}
+}
+
+// clockDrift returns how far the thermostat clock is ahead of the host.  The
+// thermostat only keeps minutes so the host time is truncated to match.
+func clockDrift(params TStatDateTime, now time.Time) time.Duration {
+	return params.toTime().Sub(now.Truncate(time.Minute))
+}
+
+func getTstatTime(priority actionPriority) (*APITStatTime, bool) {
+	params := TStatDateTime{}
+	ok := infinity.ReadTablePriority(devTSTAT, &params, priority)
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	drift := clockDrift(params, now)
+	if drift < 0 {
+		drift = -drift
+	}
+
+	return &APITStatTime{
+		TStatTime: params.toTime().Format(clockLayout),
+		HostTime:  now.Format(clockLayout),
+		DayOfWeek: time.Weekday(params.DayOfWeek % 7).String(),
+		Drift:     int64(clockDrift(params, now) / time.Second),
+		InSync:    drift < clockSyncThreshold && time.Weekday(params.DayOfWeek) == now.Weekday(),
+	}, true
+}
+
+// setTstatTime writes the host's local time and day of week.  It isn't
+// verified by -verify-writes since the clock moves on between the write and
+// the read back.
+func setTstatTime() bool {
+	now := time.Now()
+	log.Infof("setting thermostat clock to %s", now.Format(clockLayout))
+	return infinity.WriteTable(devTSTAT, tstatDateTime(now), 0x3f)
+}
+
+// nearDSTTransition reports whether a daylight saving change happens within
+// window of t.  The thermostat may apply the change itself, so correcting
+// the clock right around it risks adjusting twice.
+func nearDSTTransition(t time.Time, window time.Duration) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-window).Zone()
+	_, after := t.Add(window).Zone()
+	return offset != before || offset != after
+}
+
+func clockSyncer() {
+	for {
+		time.Sleep(clockSyncInterval)
+
+		if nearDSTTransition(time.Now(), 10*time.Minute) {
+			log.Info("skipping clock sync near daylight saving transition")
+			continue
+		}
+
+		tt, ok := getTstatTime(priorityPoll)
+		if !ok {
+			continue
+		}
+
+		if !tt.InSync {
+			log.Infof("thermostat clock is off by %ds", tt.Drift)
+			setTstatTime()
+		}
+	}
+}
@@ -1,5 +1,31 @@
 package main
 
+// Missing or faulted temperature sensors report the most negative value of
+// the field rather than a temperature.
+const (
+	sensorFaultTemp   = int8(-128)
+	sensorFaultTemp16 = int16(-32768)
+)
+
+// sensorTemp decodes a signed temperature, returning nil for a sensor fault.
+func sensorTemp(raw int8) *float64 {
+	if raw == sensorFaultTemp {
+		return nil
+	}
+	t := float64(raw)
+	return &t
+}
+
+// sensorTemp16 decodes a signed 12.4 fixed point temperature as used by the
+// outdoor unit, returning nil for a sensor fault.
+func sensorTemp16(raw int16) *float32 {
+	if raw == sensorFaultTemp16 {
+		return nil
+	}
+	t := float32(raw) / float32(16)
+	return &t
+}
+
 func rawModeToString(mode uint8) string {
 	switch mode {
 	case 0:
@@ -20,18 +46,22 @@ func rawModeToString(mode uint8) string {
 	}
 }
 
-func stringModeToRaw(mode string) uint8 {
+func stringModeToRaw(mode string) (uint8, bool) {
 	switch mode {
 	case "heat":
-		return 0
+		return 0, true
 	case "cool":
-		return 1
+		return 1, true
 	case "auto":
-		return 2
+		return 2, true
+	case "electric", "emheat":
+		return 3, true
+	case "heatpump":
+		return 4, true
 	case "off":
-		return 5
+		return 5, true
 	default:
-		return 5
+		return 5, false
 	}
 }
 
@@ -64,3 +94,133 @@ func stringFanModeToRaw(mode string) (uint8, bool) {
 		return 0, false
 	}
 }
+
+func rawInducerToString(inducer uint8) string {
+	switch inducer {
+	case 0:
+		return "off"
+	case 1:
+		return "low"
+	case 2:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// The reversing valve is energized for cooling, and for defrost.
+func rawReversingValveToString(valve uint8) string {
+	if valve != 0 {
+		return "cool"
+	}
+	return "heat"
+}
+
+func rawVentilatorTypeToString(ventilator uint8) string {
+	switch ventilator {
+	case 0:
+		return "none"
+	case 1:
+		return "erv"
+	case 2:
+		return "hrv"
+	case 3:
+		return "freshair"
+	default:
+		return "unknown"
+	}
+}
+
+func rawVentilationLevelToString(level uint8) string {
+	switch level {
+	case 0:
+		return "off"
+	case 1:
+		return "low"
+	case 2:
+		return "high"
+	case 3:
+		return "auto"
+	default:
+		return "unknown"
+	}
+}
+
+func stringVentilationLevelToRaw(level string) (uint8, bool) {
+	switch level {
+	case "off":
+		return 0, true
+	case "low":
+		return 1, true
+	case "high":
+		return 2, true
+	case "auto":
+		return 3, true
+	default:
+		return 0, false
+	}
+}
+
+func rawBacklightToString(backlight uint8) string {
+	switch backlight {
+	case 0:
+		return "off"
+	case 1:
+		return "on"
+	case 2:
+		return "auto"
+	default:
+		return "unknown"
+	}
+}
+
+func stringBacklightToRaw(backlight string) (uint8, bool) {
+	switch backlight {
+	case "off":
+		return 0, true
+	case "on":
+		return 1, true
+	case "auto":
+		return 2, true
+	default:
+		return 0, false
+	}
+}
+
+func rawTempUnitsToString(units uint8) string {
+	switch units {
+	case 0:
+		return "F"
+	case 1:
+		return "C"
+	default:
+		return "unknown"
+	}
+}
+
+func stringTempUnitsToRaw(units string) (uint8, bool) {
+	switch units {
+	case "F":
+		return 0, true
+	case "C":
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// Humidity setpoint limits accepted by the thermostat, in percent RH.
+const (
+	minHumidifySetpoint   = 5
+	maxHumidifySetpoint   = 45
+	minDehumidifySetpoint = 46
+	maxDehumidifySetpoint = 58
+)
+
+func validHumidifySetpoint(rh uint8) bool {
+	return rh >= minHumidifySetpoint && rh <= maxHumidifySetpoint
+}
+
+func validDehumidifySetpoint(rh uint8) bool {
+	return rh >= minDehumidifySetpoint && rh <= maxDehumidifySetpoint
+}
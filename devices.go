@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type APIDevice struct {
+	Address  string `json:"address"`
+	Class    string `json:"class"`
+	LastSeen string `json:"lastSeen"`
+}
+
+type APIDeviceInfo struct {
+	Address         string `json:"address"`
+	Class           string `json:"class"`
+	DeviceType      string `json:"deviceType"`
+	ModelNumber     string `json:"modelNumber"`
+	SerialNumber    string `json:"serialNumber"`
+	SoftwareVersion string `json:"softwareVersion"`
+}
+
+// Identification doesn't change while a device is powered, so it's only
+// read from the bus once per device.
+var (
+	deviceInfo      = make(map[uint16]APIDeviceInfo)
+	deviceInfoMutex = &sync.Mutex{}
+)
+
+// identifyRetry tracks outdoor units that didn't answer an identification
+// read from the poller, so they're retried with back-off.
+type identifyRetry struct {
+	failures int
+	next     time.Time
+}
+
+var identifyRetries = make(map[uint16]*identifyRetry)
+
+func (params DeviceInfo) toAPI(addr uint16) APIDeviceInfo {
+	return APIDeviceInfo{
+		Address:         fmt.Sprintf("%04x", addr),
+		Class:           deviceClass(addr),
+		DeviceType:      rawString(params.DeviceType[:]),
+		ModelNumber:     rawString(params.ModelNumber[:]),
+		SerialNumber:    rawString(params.SerialNumber[:]),
+		SoftwareVersion: rawString(params.SoftwareVersion[:]),
+	}
+}
+
+// getDevices lists the devices seen on the bus, excluding infinitive.
+func getDevices() []APIDevice {
+	devices := []APIDevice{}
+	for addr, t := range infinity.Devices() {
+		if addr == devSAM {
+			continue
+		}
+		devices = append(devices, APIDevice{
+			Address:  fmt.Sprintf("%04x", addr),
+			Class:    deviceClass(addr),
+			LastSeen: t.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices
+}
+
+// stateDevices lists the devices seen on the bus for the system state.
+// Identification is included once it has been read.
+func stateDevices() []StateDevice {
+	devices := []StateDevice{}
+	for _, d := range getDevices() {
+		addr, _ := strconv.ParseUint(d.Address, 16, 16)
+
+		deviceInfoMutex.Lock()
+		info, ok := deviceInfo[uint16(addr)]
+		deviceInfoMutex.Unlock()
+
+		sd := StateDevice{Address: d.Address, Class: d.Class}
+		if ok {
+			sd.Info = &info
+		}
+		devices = append(devices, sd)
+	}
+	return devices
+}
+
+// outdoorType reports whether the outdoor unit is a heat pump and whether
+// that is known yet, which it is once the heat pump table has been seen or
+// the outdoor unit's identification has been read.
+func outdoorType() (heatPump bool, known bool) {
+	if heatPumpDetected.Load() {
+		return true, true
+	}
+
+	deviceInfoMutex.Lock()
+	defer deviceInfoMutex.Unlock()
+	for addr, info := range deviceInfo {
+		if deviceClass(addr) != "outdoor" {
+			continue
+		}
+		t := strings.ToUpper(strings.ReplaceAll(info.DeviceType, " ", ""))
+		return strings.Contains(t, "HEATPUMP"), true
+	}
+	return false, false
+}
+
+// identifyOutdoorUnits reads the identification of any outdoor unit seen on
+// the bus, so the available modes can be narrowed down.  It's only called
+// from the poller.
+func identifyOutdoorUnits(now time.Time) {
+	for addr := range infinity.Devices() {
+		if deviceClass(addr) != "outdoor" {
+			continue
+		}
+		retry, ok := identifyRetries[addr]
+		if ok && now.Before(retry.next) {
+			continue
+		}
+		if _, ok := getDeviceInfo(addr, priorityPoll); ok {
+			delete(identifyRetries, addr)
+			continue
+		}
+		if retry == nil {
+			retry = &identifyRetry{}
+			identifyRetries[addr] = retry
+		}
+		retry.failures++
+		retry.next = now.Add(jitter(retryBackoff(retry.failures)))
+		log.Debugf("identifying outdoor unit %04x failed %d times", addr, retry.failures)
+	}
+}
+
+func deviceDiscovered(addr uint16) bool {
+	_, ok := infinity.Devices()[addr]
+	return ok
+}
+
+func getDeviceInfo(addr uint16, priority actionPriority) (*APIDeviceInfo, bool) {
+	deviceInfoMutex.Lock()
+	info, ok := deviceInfo[addr]
+	deviceInfoMutex.Unlock()
+	if ok {
+		return &info, true
+	}
+
+	params := DeviceInfo{}
+	if !infinity.ReadTablePriority(addr, &params, priority) {
+		return nil, false
+	}
+
+	info = params.toAPI(addr)
+
+	deviceInfoMutex.Lock()
+	deviceInfo[addr] = info
+	deviceInfoMutex.Unlock()
+
+	return &info, true
+}
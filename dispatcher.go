@@ -5,12 +5,13 @@ import (
 )
 
 type EventListener struct {
-	ch chan []byte
+	ch    chan []byte
+	units tempUnits
 }
 
 type EventDispatcher struct {
 	listeners  map[*EventListener]bool
-	broadcast  chan []byte
+	broadcast  chan *broadcastEvent
 	register   chan *EventListener
 	deregister chan *EventListener
 }
@@ -19,17 +20,13 @@ var Dispatcher *EventDispatcher = newEventDispatcher()
 
 func newEventDispatcher() *EventDispatcher {
 	return &EventDispatcher{
-		broadcast:  make(chan []byte, 64),
+		broadcast:  make(chan *broadcastEvent, 64),
 		register:   make(chan *EventListener),
 		deregister: make(chan *EventListener),
 		listeners:  make(map[*EventListener]bool),
 	}
 }
 
-func (d *EventDispatcher) dispatch(msg []byte) {
-	d.broadcast <- msg
-}
-
 type broadcastEvent struct {
 	Source string      `json:"source"`
 	Data   interface{} `json:"data"`
@@ -41,7 +38,7 @@ func serializeEvent(source string, data interface{}) []byte {
 }
 
 func (d *EventDispatcher) broadcastEvent(source string, data interface{}) {
-	d.broadcast <- serializeEvent(source, data)
+	d.broadcast <- &broadcastEvent{Source: source, Data: data}
 }
 
 func (h *EventDispatcher) run() {
@@ -54,8 +51,15 @@ func (h *EventDispatcher) run() {
 				delete(h.listeners, listener)
 				close(listener.ch)
 			}
-		case message := <-h.broadcast:
+		case event := <-h.broadcast:
+			// serialize once per distinct units setting
+			messages := make(map[tempUnits][]byte)
 			for listener := range h.listeners {
+				message, ok := messages[listener.units]
+				if !ok {
+					message = serializeEvent(event.Source, convertUnits(event.Data, listener.units))
+					messages[listener.units] = message
+				}
 				select {
 				case listener.ch <- message:
 				default:
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interval between fault history checks, set from the command line
+var faultCheckInterval = 5 * time.Minute
+
+// Fault codes are specific to the class of device reporting them.
+var faultDescriptions = map[string]map[uint8]string{
+	"thermostat": {
+		16: "communication failure",
+		17: "thermostat temperature sensor fault",
+		18: "outdoor temperature sensor fault",
+		19: "humidity sensor fault",
+		20: "remote sensor fault",
+	},
+	"indoor": {
+		12: "blower on after power up",
+		13: "limit circuit lockout",
+		14: "ignition lockout",
+		15: "blower motor lockout",
+		16: "communication failure",
+		21: "gas heating lockout",
+		22: "abnormal flame-proving signal",
+		23: "pressure switch did not open",
+		24: "secondary voltage fuse open",
+		31: "high heat pressure switch did not close or reopened",
+		32: "low heat pressure switch did not close or reopened",
+		33: "limit circuit fault",
+		34: "ignition proving failure",
+		41: "blower motor fault",
+		42: "inducer motor fault",
+		43: "low heat pressure switch open with high heat pressure switch closed",
+		44: "blower motor speed fault",
+		45: "control circuitry lockout",
+	},
+	"outdoor": {
+		16: "communication failure",
+		25: "model or size mismatch",
+		31: "high pressure switch open",
+		32: "low pressure switch open",
+		46: "brownout",
+		47: "lost 24V power",
+		48: "lost 230V power",
+		53: "outdoor air temperature sensor fault",
+		54: "suction temperature sensor fault",
+		55: "coil temperature sensor fault",
+		56: "suction and coil temperature sensors swapped",
+		59: "loss of charge",
+		71: "compressor contactor fault",
+		74: "compressor thermal protection trip",
+		82: "suction over temperature",
+		83: "low refrigerant charge",
+		84: "high discharge temperature",
+	},
+}
+
+type APIFault struct {
+	Device      string `json:"device"`
+	DeviceType  string `json:"deviceType"`
+	Code        uint8  `json:"code"`
+	Description string `json:"description"`
+	Time        string `json:"time"`
+	Count       uint8  `json:"count"`
+}
+
+func faultDescription(class string, code uint8) string {
+	if d, ok := faultDescriptions[class][code]; ok {
+		return d
+	}
+	return "unknown fault"
+}
+
+func (entry FaultHistoryEntry) toAPI(addr uint16) APIFault {
+	class := deviceClass(addr)
+	t := time.Date(2000+int(entry.Year), time.Month(entry.Month), int(entry.Day),
+		int(entry.Hour), int(entry.Minute), 0, 0, time.Local)
+
+	return APIFault{
+		Device:      fmt.Sprintf("%04x", addr),
+		DeviceType:  class,
+		Code:        entry.Code,
+		Description: faultDescription(class, entry.Code),
+		Time:        t.Format(time.RFC3339),
+		Count:       entry.Count,
+	}
+}
+
+// faultDevices returns the devices expected to keep a fault history: the
+// thermostat plus any indoor and outdoor units seen on the bus.
+func faultDevices() []uint16 {
+	addrs := []uint16{devTSTAT}
+	for addr := range infinity.Devices() {
+		class := deviceClass(addr)
+		if class == "indoor" || class == "outdoor" {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+// readFaults reads the fault history of every device, keyed by the devices
+// that answered.
+func readFaults(priority actionPriority) map[uint16][]APIFault {
+	faults := make(map[uint16][]APIFault)
+
+	for _, addr := range faultDevices() {
+		hist := FaultHistory{}
+		if !infinity.ReadTablePriority(addr, &hist, priority) {
+			log.Debugf("no fault history from %04x", addr)
+			continue
+		}
+
+		faults[addr] = []APIFault{}
+		for _, entry := range hist.Entries {
+			if entry.Code != 0 {
+				faults[addr] = append(faults[addr], entry.toAPI(addr))
+			}
+		}
+	}
+
+	return faults
+}
+
+// getFaults returns the fault history of every device that answers.  It
+// only fails if none do.
+func getFaults() ([]APIFault, bool) {
+	byDevice := readFaults(priorityRead)
+	if len(byDevice) == 0 {
+		return nil, false
+	}
+
+	faults := []APIFault{}
+	for _, addr := range faultDevices() {
+		faults = append(faults, byDevice[addr]...)
+	}
+	return faults, true
+}
+
+func faultKey(f APIFault) string {
+	return fmt.Sprintf("%d/%s", f.Code, f.Time)
+}
+
+// faultWatcher periodically reads the fault histories and broadcasts a
+// "fault" event for every entry that is new or whose count has gone up.
+// The first history read from each device only sets a baseline, so faults
+// from before infinitive started are not reported.
+func faultWatcher() {
+	known := make(map[uint16]map[string]uint8)
+
+	for {
+		for addr, faults := range readFaults(priorityPoll) {
+			prev, baseline := known[addr]
+			seen := make(map[string]uint8, len(faults))
+
+			for _, f := range faults {
+				key := faultKey(f)
+				seen[key] = f.Count
+
+				if !baseline {
+					continue
+				}
+				if count, ok := prev[key]; !ok || f.Count > count {
+					log.Warnf("new fault on %s: %d %s", f.Device, f.Code, f.Description)
+					Dispatcher.broadcastEvent("fault", f)
+				}
+			}
+			known[addr] = seen
+		}
+
+		time.Sleep(faultCheckInterval)
+	}
+}
@@ -29,11 +29,14 @@ type InfinityFrame struct {
 	data    []byte
 }
 
-var writeAck = &InfinityFrame{
-	src:  devSAM,
-	dst:  devTSTAT,
-	op:   opRESPONSE,
-	data: []byte{0x00},
+// ack returns the response acknowledging a write.
+func (f *InfinityFrame) ack() *InfinityFrame {
+	return &InfinityFrame{
+		src:  f.dst,
+		dst:  f.src,
+		op:   opRESPONSE,
+		data: []byte{0x00},
+	}
 }
 
 func checksum(b []byte) []byte {
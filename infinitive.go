@@ -3,281 +3,487 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type TStatZone0Config struct {
-	CurrentTempZ1     uint8  `json:"currentTempZ1"`
-	CurrentHumidityZ1 uint8  `json:"currentHumidityZ1"`
-	CurrentTempZ2     uint8  `json:"currentTempZ2"`
-	CurrentHumidityZ2 uint8  `json:"currentHumidityZ2"`
-	CurrentTempZ3     uint8  `json:"currentTempZ3"`
-	CurrentHumidityZ3 uint8  `json:"currentHumidityZ3"`
-	CurrentTempZ4     uint8  `json:"currentTempZ4"`
-	CurrentHumidityZ4 uint8  `json:"currentHumidityZ4"`
-	OutdoorTemp       uint8  `json:"outdoorTemp"`
-	Mode              string `json:"mode"`
-	Stage             uint8  `json:"stage"`
-	FanModeZ1         string `json:"fanModeZ1"`
-	FanModeZ2         string `json:"fanModeZ2"`
-	FanModeZ3         string `json:"fanModeZ3"`
-	FanModeZ4         string `json:"fanModeZ4"`
-	Hold              *bool  `json:"hold"`
-	HeatSetpointZ1    uint8  `json:"heatSetpointZ1"`
-	CoolSetpointZ1    uint8  `json:"coolSetpointZ1"`
-	HeatSetpointZ2    uint8  `json:"heatSetpointZ2"`
-	CoolSetpointZ2    uint8  `json:"coolSetpointZ2"`
-	HeatSetpointZ3    uint8  `json:"heatSetpointZ3"`
-	CoolSetpointZ3    uint8  `json:"coolSetpointZ3"`
-	HeatSetpointZ4    uint8  `json:"heatSetpointZ4"`
-	CoolSetpointZ4    uint8  `json:"coolSetpointZ4"`
-	RawMode           uint8  `json:"rawMode"`
+	CurrentTempZ1        *float64 `json:"currentTempZ1"`
+	CurrentHumidityZ1    uint8    `json:"currentHumidityZ1"`
+	CurrentTempZ2        *float64 `json:"currentTempZ2"`
+	CurrentHumidityZ2    uint8    `json:"currentHumidityZ2"`
+	CurrentTempZ3        *float64 `json:"currentTempZ3"`
+	CurrentHumidityZ3    uint8    `json:"currentHumidityZ3"`
+	CurrentTempZ4        *float64 `json:"currentTempZ4"`
+	CurrentHumidityZ4    uint8    `json:"currentHumidityZ4"`
+	OutdoorTemp          *float64 `json:"outdoorTemp"`
+	Mode                 string   `json:"mode"`
+	Stage                uint8    `json:"stage"`
+	FanModeZ1            string   `json:"fanModeZ1"`
+	FanModeZ2            string   `json:"fanModeZ2"`
+	FanModeZ3            string   `json:"fanModeZ3"`
+	FanModeZ4            string   `json:"fanModeZ4"`
+	Hold                 *bool    `json:"hold"`
+	HeatSetpointZ1       float64  `json:"heatSetpointZ1"`
+	CoolSetpointZ1       float64  `json:"coolSetpointZ1"`
+	HeatSetpointZ2       float64  `json:"heatSetpointZ2"`
+	CoolSetpointZ2       float64  `json:"coolSetpointZ2"`
+	HeatSetpointZ3       float64  `json:"heatSetpointZ3"`
+	CoolSetpointZ3       float64  `json:"coolSetpointZ3"`
+	HeatSetpointZ4       float64  `json:"heatSetpointZ4"`
+	CoolSetpointZ4       float64  `json:"coolSetpointZ4"`
+	HumidifySetpointZ1   uint8    `json:"humidifySetpointZ1"`
+	DehumidifySetpointZ1 uint8    `json:"dehumidifySetpointZ1"`
+	HumidifySetpointZ2   uint8    `json:"humidifySetpointZ2"`
+	DehumidifySetpointZ2 uint8    `json:"dehumidifySetpointZ2"`
+	HumidifySetpointZ3   uint8    `json:"humidifySetpointZ3"`
+	DehumidifySetpointZ3 uint8    `json:"dehumidifySetpointZ3"`
+	HumidifySetpointZ4   uint8    `json:"humidifySetpointZ4"`
+	DehumidifySetpointZ4 uint8    `json:"dehumidifySetpointZ4"`
+	Humidifying          bool     `json:"humidifying"`
+	Dehumidifying        bool     `json:"dehumidifying"`
+	RawMode              uint8    `json:"rawMode"`
 }
 
 type TStatZoneConfig struct {
-	CurrentTemp     uint8  `json:"currentTemp"`
-	CurrentHumidity uint8  `json:"currentHumidity"`
-	OutdoorTemp     uint8  `json:"outdoorTemp"`
-	Mode            string `json:"mode"`
-	Stage           uint8  `json:"stage"`
-	FanMode         string `json:"fanMode"`
-	Hold            *bool  `json:"hold"`
-	HeatSetpoint    uint8  `json:"heatSetpoint"`
-	CoolSetpoint    uint8  `json:"coolSetpoint"`
-	RawMode         uint8  `json:"rawMode"`
+	CurrentTemp        *float64 `json:"currentTemp"`
+	CurrentHumidity    uint8    `json:"currentHumidity"`
+	OutdoorTemp        *float64 `json:"outdoorTemp"`
+	Mode               string   `json:"mode"`
+	Stage              uint8    `json:"stage"`
+	FanMode            string   `json:"fanMode"`
+	Hold               *bool    `json:"hold"`
+	HeatSetpoint       *float64 `json:"heatSetpoint"`
+	CoolSetpoint       *float64 `json:"coolSetpoint"`
+	HumidifySetpoint   uint8    `json:"humidifySetpoint"`
+	DehumidifySetpoint uint8    `json:"dehumidifySetpoint"`
+	Humidifying        bool     `json:"humidifying"`
+	Dehumidifying      bool     `json:"dehumidifying"`
+	DamperPosition     *uint8   `json:"damperPosition"`
+	AirflowShare       *uint8   `json:"airflowShare"`
+	RawMode            uint8    `json:"rawMode"`
 }
 
+func (cfg TStatZone0Config) inUnits(u tempUnits) interface{} {
+	cfg.CurrentTempZ1 = u.optFromF(cfg.CurrentTempZ1)
+	cfg.CurrentTempZ2 = u.optFromF(cfg.CurrentTempZ2)
+	cfg.CurrentTempZ3 = u.optFromF(cfg.CurrentTempZ3)
+	cfg.CurrentTempZ4 = u.optFromF(cfg.CurrentTempZ4)
+	cfg.OutdoorTemp = u.optFromF(cfg.OutdoorTemp)
+	cfg.HeatSetpointZ1 = u.fromF(cfg.HeatSetpointZ1)
+	cfg.CoolSetpointZ1 = u.fromF(cfg.CoolSetpointZ1)
+	cfg.HeatSetpointZ2 = u.fromF(cfg.HeatSetpointZ2)
+	cfg.CoolSetpointZ2 = u.fromF(cfg.CoolSetpointZ2)
+	cfg.HeatSetpointZ3 = u.fromF(cfg.HeatSetpointZ3)
+	cfg.CoolSetpointZ3 = u.fromF(cfg.CoolSetpointZ3)
+	cfg.HeatSetpointZ4 = u.fromF(cfg.HeatSetpointZ4)
+	cfg.CoolSetpointZ4 = u.fromF(cfg.CoolSetpointZ4)
+	return cfg
+}
+
+func (cfg TStatZoneConfig) inUnits(u tempUnits) interface{} {
+	cfg.CurrentTemp = u.optFromF(cfg.CurrentTemp)
+	cfg.OutdoorTemp = u.optFromF(cfg.OutdoorTemp)
+	cfg.HeatSetpoint = u.optFromF(cfg.HeatSetpoint)
+	cfg.CoolSetpoint = u.optFromF(cfg.CoolSetpoint)
+	return cfg
+}
+
+type ZoneConfigs map[string]TStatZoneConfig
+
+func (zones ZoneConfigs) inUnits(u tempUnits) interface{} {
+	out := make(ZoneConfigs, len(zones))
+	for zone, cfg := range zones {
+		out[zone] = cfg.inUnits(u).(TStatZoneConfig)
+	}
+	return out
+}
+
+// fromUnits converts the writable setpoints of an update given in u to
+// Fahrenheit.  Unset setpoints are left alone.
+func (cfg *TStatZoneConfig) fromUnits(u tempUnits) {
+	if cfg.HeatSetpoint != nil {
+		t := u.toF(*cfg.HeatSetpoint)
+		cfg.HeatSetpoint = &t
+	}
+	if cfg.CoolSetpoint != nil {
+		t := u.toF(*cfg.CoolSetpoint)
+		cfg.CoolSetpoint = &t
+	}
+}
+
+// Indoor unit state.  The furnace fields stay at their zero values on fan
+// coil systems and the electric heat fields on furnace systems.
 type AirHandler struct {
-	BlowerRPM  uint16 `json:"blowerRPM"`
-	AirFlowCFM uint16 `json:"airFlowCFM"`
-	ElecHeat   bool   `json:"elecHeat"`
+	BlowerRPM      uint16  `json:"blowerRPM"`
+	AirFlowCFM     uint16  `json:"airFlowCFM"`
+	TargetCFM      uint16  `json:"targetCFM"`
+	StaticPressure float32 `json:"staticPressure"` // inches of water column
+	ElecHeat       bool    `json:"elecHeat"`
+	ElecHeatStage  uint8   `json:"elecHeatStage"`
+	HeatStage      uint8   `json:"heatStage"`
+	Inducer        string  `json:"inducer"`
+	InducerRPM     uint16  `json:"inducerRPM"`
+	FlameSensed    bool    `json:"flameSensed"`
+	GasValve       bool    `json:"gasValve"`
 }
 
+// Temperatures are nil when the outdoor unit reports a sensor fault or
+// doesn't have the sensor.  CompressorRPM is only reported by variable speed
+// units.
 type HeatPump struct {
-	CoilTemp    float32 `json:"coilTemp"`
-	OutsideTemp float32 `json:"outsideTemp"`
-	Stage       uint8   `json:"stage"`
+	CoilTemp       *float32   `json:"coilTemp"`
+	OutsideTemp    *float32   `json:"outsideTemp"`
+	DischargeTemp  *float32   `json:"dischargeTemp"`
+	SuctionTemp    *float32   `json:"suctionTemp"`
+	Stage          uint8      `json:"stage"`
+	CompressorOn   bool       `json:"compressorOn"`
+	CompressorRPM  uint16     `json:"compressorRPM"`
+	ReversingValve string     `json:"reversingValve"`
+	Defrost        bool       `json:"defrost"`
+	LastDefrost    *time.Time `json:"lastDefrost"`
+	FaultCode      uint8      `json:"faultCode"`
+}
+
+func (hp HeatPump) inUnits(u tempUnits) interface{} {
+	hp.CoilTemp = u.optSensorFromF(hp.CoilTemp)
+	hp.OutsideTemp = u.optSensorFromF(hp.OutsideTemp)
+	hp.DischargeTemp = u.optSensorFromF(hp.DischargeTemp)
+	hp.SuctionTemp = u.optSensorFromF(hp.SuctionTemp)
+	return hp
+}
+
+// Damper control module state, indexed by zone number minus one.  Only
+// present on zoned systems.
+type Dampers struct {
+	Position     [maxZones]uint8 `json:"position"`     // percent open
+	AirflowShare [maxZones]uint8 `json:"airflowShare"` // percent of total air flow
 }
 
 var infinity *InfinityProtocol
 
-func getZ0Config() (*TStatZone0Config, bool) {
-	cfg := TStatZoneParams{}
-	ok := infinity.ReadTable(devTSTAT, &cfg)
+// number of zones carried in the thermostat zone tables
+const maxZones = 8
+
+// zoneTables holds the thermostat tables the zone configs are built from.
+type zoneTables struct {
+	cfg    TStatZoneParams
+	params TStatCurrentParams
+	hum    TStatHumidityParams
+}
+
+func readZoneTables(priority actionPriority) (*zoneTables, bool) {
+	t := &zoneTables{}
+	ok := infinity.ReadTablePriority(devTSTAT, &t.cfg, priority)
 	if !ok {
 		return nil, false
 	}
 
-	params := TStatCurrentParams{}
-	ok = infinity.ReadTable(devTSTAT, &params)
+	ok = infinity.ReadTablePriority(devTSTAT, &t.params, priority)
 	if !ok {
 		return nil, false
 	}
 
-	hold := new(bool)
-	*hold = cfg.ZoneHold&0x01 == 1
+	ok = infinity.ReadTablePriority(devTSTAT, &t.hum, priority)
+	if !ok {
+		return nil, false
+	}
 
-	return &TStatZone0Config{
-		CurrentTempZ1:     params.Z1CurrentTemp,
-		CurrentTempZ2:     params.Z2CurrentTemp,
-		CurrentTempZ3:     params.Z3CurrentTemp,
-		CurrentTempZ4:     params.Z4CurrentTemp,
-		CurrentHumidityZ1: params.Z1CurrentHumidity,
-		CurrentHumidityZ2: params.Z2CurrentHumidity,
-		CurrentHumidityZ3: params.Z3CurrentHumidity,
-		CurrentHumidityZ4: params.Z4CurrentHumidity,
-		OutdoorTemp:       params.OutdoorAirTemp,
-		Mode:              rawModeToString(params.Mode & 0xf),
-		Stage:             params.Mode >> 5,
-		FanModeZ1:         rawFanModeToString(cfg.Z1FanMode),
-		FanModeZ2:         rawFanModeToString(cfg.Z2FanMode),
-		FanModeZ3:         rawFanModeToString(cfg.Z3FanMode),
-		FanModeZ4:         rawFanModeToString(cfg.Z4FanMode),
-		Hold:              hold,
-		HeatSetpointZ1:    cfg.Z1HeatSetpoint,
-		CoolSetpointZ1:    cfg.Z1CoolSetpoint,
-		HeatSetpointZ2:    cfg.Z2HeatSetpoint,
-		CoolSetpointZ2:    cfg.Z2CoolSetpoint,
-		HeatSetpointZ3:    cfg.Z3HeatSetpoint,
-		CoolSetpointZ3:    cfg.Z3CoolSetpoint,
-		HeatSetpointZ4:    cfg.Z4HeatSetpoint,
-		CoolSetpointZ4:    cfg.Z4CoolSetpoint,
-		RawMode:           params.Mode,
-	}, true
+	return t, true
 }
 
-func getZ1Config() (*TStatZoneConfig, bool) {
-	cfg := TStatZoneParams{}
-	ok := infinity.ReadTable(devTSTAT, &cfg)
-	if !ok {
-		return nil, false
+func (t *zoneTables) zoneConfig(zone int) *TStatZoneConfig {
+	cfg, params, hum := &t.cfg, &t.params, &t.hum
+	z := zone - 1
+
+	hold := new(bool)
+	*hold = cfg.ZoneHold&(0x01<<z) != 0
+
+	heat := float64(cfg.HeatSetpoint[z])
+	cool := float64(cfg.CoolSetpoint[z])
+
+	zc := &TStatZoneConfig{
+		CurrentTemp:        sensorTemp(params.CurrentTemp[z]),
+		CurrentHumidity:    params.CurrentHumidity[z],
+		OutdoorTemp:        sensorTemp(params.OutdoorAirTemp),
+		Mode:               rawModeToString(params.Mode & 0xf),
+		Stage:              params.Mode >> 5,
+		FanMode:            rawFanModeToString(cfg.FanMode[z]),
+		Hold:               hold,
+		HeatSetpoint:       &heat,
+		CoolSetpoint:       &cool,
+		HumidifySetpoint:   cfg.TargetHumidity[z],
+		DehumidifySetpoint: hum.DehumidifySetpoint[z],
+		Humidifying:        hum.Active&0x01 != 0,
+		Dehumidifying:      hum.Active&0x02 != 0,
+		RawMode:            params.Mode,
 	}
 
-	params := TStatCurrentParams{}
-	ok = infinity.ReadTable(devTSTAT, &params)
-	if !ok {
-		return nil, false
+	if dampers, ok := getDampers(); ok {
+		zc.DamperPosition = &dampers.Position[z]
+		zc.AirflowShare = &dampers.AirflowShare[z]
+	}
+
+	return zc
+}
+
+// zoneConfigs returns the configs of every configured zone keyed by zone
+// number.
+func (t *zoneTables) zoneConfigs() ZoneConfigs {
+	zones := make(ZoneConfigs)
+	for _, zone := range t.cfg.zones() {
+		zones[strconv.Itoa(zone)] = *t.zoneConfig(zone)
 	}
+	return zones
+}
+
+func (t *zoneTables) zone0Config() *TStatZone0Config {
+	cfg, params, hum := &t.cfg, &t.params, &t.hum
 
 	hold := new(bool)
 	*hold = cfg.ZoneHold&0x01 == 1
 
-	return &TStatZoneConfig{
-		CurrentTemp:     params.Z1CurrentTemp,
-		CurrentHumidity: params.Z1CurrentHumidity,
-		OutdoorTemp:     params.OutdoorAirTemp,
-		Mode:            rawModeToString(params.Mode & 0xf),
-		Stage:           params.Mode >> 5,
-		FanMode:         rawFanModeToString(cfg.Z1FanMode),
-		Hold:            hold,
-		HeatSetpoint:    cfg.Z1HeatSetpoint,
-		CoolSetpoint:    cfg.Z1CoolSetpoint,
-		RawMode:         params.Mode,
-	}, true
+	return &TStatZone0Config{
+		CurrentTempZ1:        sensorTemp(params.CurrentTemp[0]),
+		CurrentTempZ2:        sensorTemp(params.CurrentTemp[1]),
+		CurrentTempZ3:        sensorTemp(params.CurrentTemp[2]),
+		CurrentTempZ4:        sensorTemp(params.CurrentTemp[3]),
+		CurrentHumidityZ1:    params.CurrentHumidity[0],
+		CurrentHumidityZ2:    params.CurrentHumidity[1],
+		CurrentHumidityZ3:    params.CurrentHumidity[2],
+		CurrentHumidityZ4:    params.CurrentHumidity[3],
+		OutdoorTemp:          sensorTemp(params.OutdoorAirTemp),
+		Mode:                 rawModeToString(params.Mode & 0xf),
+		Stage:                params.Mode >> 5,
+		FanModeZ1:            rawFanModeToString(cfg.FanMode[0]),
+		FanModeZ2:            rawFanModeToString(cfg.FanMode[1]),
+		FanModeZ3:            rawFanModeToString(cfg.FanMode[2]),
+		FanModeZ4:            rawFanModeToString(cfg.FanMode[3]),
+		Hold:                 hold,
+		HeatSetpointZ1:       float64(cfg.HeatSetpoint[0]),
+		CoolSetpointZ1:       float64(cfg.CoolSetpoint[0]),
+		HeatSetpointZ2:       float64(cfg.HeatSetpoint[1]),
+		CoolSetpointZ2:       float64(cfg.CoolSetpoint[1]),
+		HeatSetpointZ3:       float64(cfg.HeatSetpoint[2]),
+		CoolSetpointZ3:       float64(cfg.CoolSetpoint[2]),
+		HeatSetpointZ4:       float64(cfg.HeatSetpoint[3]),
+		CoolSetpointZ4:       float64(cfg.CoolSetpoint[3]),
+		HumidifySetpointZ1:   cfg.TargetHumidity[0],
+		DehumidifySetpointZ1: hum.DehumidifySetpoint[0],
+		HumidifySetpointZ2:   cfg.TargetHumidity[1],
+		DehumidifySetpointZ2: hum.DehumidifySetpoint[1],
+		HumidifySetpointZ3:   cfg.TargetHumidity[2],
+		DehumidifySetpointZ3: hum.DehumidifySetpoint[2],
+		HumidifySetpointZ4:   cfg.TargetHumidity[3],
+		DehumidifySetpointZ4: hum.DehumidifySetpoint[3],
+		Humidifying:          hum.Active&0x01 != 0,
+		Dehumidifying:        hum.Active&0x02 != 0,
+		RawMode:              params.Mode,
+	}
 }
 
-func getZ2Config() (*TStatZoneConfig, bool) {
-	cfg := TStatZoneParams{}
-	ok := infinity.ReadTable(devTSTAT, &cfg)
-	if !ok {
-		return nil, false
+// set by the heat pump snoop once the outdoor unit answers a heat pump table
+var heatPumpDetected atomic.Bool
+
+// validModes returns the modes that can be selected with the equipment
+// discovered on the bus.  Every mode is allowed until the type of the
+// outdoor unit is known, since a heat pump can't be told from an air
+// conditioner before then.
+func validModes() []string {
+	heatPump, known := outdoorType()
+	if !known {
+		return []string{"off", "heat", "cool", "auto", "electric", "heatpump"}
 	}
 
-	params := TStatCurrentParams{}
-	ok = infinity.ReadTable(devTSTAT, &params)
-	if !ok {
-		return nil, false
+	indoor := false
+	for addr := range infinity.Devices() {
+		if deviceClass(addr) == "indoor" {
+			indoor = true
+		}
 	}
 
-	hold := new(bool)
-	*hold = cfg.ZoneHold&0x01 == 1
-
-	return &TStatZoneConfig{
-		CurrentTemp:     params.Z2CurrentTemp,
-		CurrentHumidity: params.Z2CurrentHumidity,
-		OutdoorTemp:     params.OutdoorAirTemp,
-		Mode:            rawModeToString(params.Mode & 0xf),
-		Stage:           params.Mode >> 5,
-		FanMode:         rawFanModeToString(cfg.Z2FanMode),
-		Hold:            hold,
-		HeatSetpoint:    cfg.Z2HeatSetpoint,
-		CoolSetpoint:    cfg.Z2CoolSetpoint,
-		RawMode:         params.Mode,
-	}, true
+	modes := []string{"off"}
+	if indoor || heatPump {
+		modes = append(modes, "heat")
+	}
+	modes = append(modes, "cool")
+	if indoor || heatPump {
+		modes = append(modes, "auto")
+	}
+	if heatPump {
+		// emergency heat requires an indoor heat source to fall back on
+		if indoor {
+			modes = append(modes, "electric")
+		}
+		modes = append(modes, "heatpump")
+	}
+	return modes
 }
 
-func getZ3Config() (*TStatZoneConfig, bool) {
-	cfg := TStatZoneParams{}
-	ok := infinity.ReadTable(devTSTAT, &cfg)
+func validMode(mode string) bool {
+	raw, ok := stringModeToRaw(mode)
 	if !ok {
-		return nil, false
+		return false
+	}
+	for _, m := range validModes() {
+		if m == rawModeToString(raw) {
+			return true
+		}
 	}
+	return false
+}
 
-	params := TStatCurrentParams{}
-	ok = infinity.ReadTable(devTSTAT, &params)
-	if !ok {
-		return nil, false
+// validateZoneConfig checks the writable fields of a zone config update.
+func validateZoneConfig(args *TStatZoneConfig) error {
+	if len(args.Mode) > 0 && !validMode(args.Mode) {
+		return fmt.Errorf("invalid mode for this system: %s", args.Mode)
 	}
 
-	hold := new(bool)
-	*hold = cfg.ZoneHold&0x01 == 1
+	if len(args.FanMode) > 0 {
+		if _, ok := stringFanModeToRaw(args.FanMode); !ok {
+			return fmt.Errorf("invalid fan mode: %s", args.FanMode)
+		}
+	}
+
+	if args.HeatSetpoint != nil && !validSetpoint(*args.HeatSetpoint, minHeatSetpoint, maxHeatSetpoint) {
+		return fmt.Errorf("heatSetpoint must be between %d and %d", minHeatSetpoint, maxHeatSetpoint)
+	}
+
+	if args.CoolSetpoint != nil && !validSetpoint(*args.CoolSetpoint, minCoolSetpoint, maxCoolSetpoint) {
+		return fmt.Errorf("coolSetpoint must be between %d and %d", minCoolSetpoint, maxCoolSetpoint)
+	}
 
-	return &TStatZoneConfig{
-		CurrentTemp:     params.Z3CurrentTemp,
-		CurrentHumidity: params.Z3CurrentHumidity,
-		OutdoorTemp:     params.OutdoorAirTemp,
-		Mode:            rawModeToString(params.Mode & 0xf),
-		Stage:           params.Mode >> 5,
-		FanMode:         rawFanModeToString(cfg.Z3FanMode),
-		Hold:            hold,
-		HeatSetpoint:    cfg.Z3HeatSetpoint,
-		CoolSetpoint:    cfg.Z3CoolSetpoint,
-		RawMode:         params.Mode,
-	}, true
+	if args.HeatSetpoint != nil && args.CoolSetpoint != nil && rawTemp(*args.HeatSetpoint) >= rawTemp(*args.CoolSetpoint) {
+		return errors.New("heatSetpoint must be below coolSetpoint")
+	}
+
+	if args.HumidifySetpoint > 0 && !validHumidifySetpoint(args.HumidifySetpoint) {
+		return fmt.Errorf("humidifySetpoint must be between %d and %d",
+			minHumidifySetpoint, maxHumidifySetpoint)
+	}
+
+	if args.DehumidifySetpoint > 0 && !validDehumidifySetpoint(args.DehumidifySetpoint) {
+		return fmt.Errorf("dehumidifySetpoint must be between %d and %d",
+			minDehumidifySetpoint, maxDehumidifySetpoint)
+	}
+
+	return nil
 }
 
-func getZ4Config() (*TStatZoneConfig, bool) {
-	cfg := TStatZoneParams{}
-	ok := infinity.ReadTable(devTSTAT, &cfg)
-	if !ok {
-		return nil, false
+// putZoneConfig writes the non-zero fields of args to the given zone.  The
+// zone tables are read first so that values belonging to other zones are
+// written back unchanged.
+func putZoneConfig(zone int, args *TStatZoneConfig) (bool, error) {
+	z := zone - 1
+
+	// refresh the state even after a partial write
+	defer pollNow("zones")
+
+	params := TStatZoneParams{}
+	flags := byte(0)
+
+	if len(args.FanMode) > 0 || args.Hold != nil || args.HeatSetpoint != nil ||
+		args.CoolSetpoint != nil || args.HumidifySetpoint > 0 {
+		if !infinity.ReadTable(devTSTAT, &params) {
+			return false, nil
+		}
 	}
 
-	params := TStatCurrentParams{}
-	ok = infinity.ReadTable(devTSTAT, &params)
-	if !ok {
-		return nil, false
+	if len(args.FanMode) > 0 {
+		mode, _ := stringFanModeToRaw(args.FanMode)
+		params.FanMode[z] = mode
+		flags |= 0x01
 	}
 
-	hold := new(bool)
-	*hold = cfg.ZoneHold&0x01 == 1
+	if args.Hold != nil {
+		if *args.Hold {
+			params.ZoneHold |= 0x01 << z
+		} else {
+			params.ZoneHold &^= 0x01 << z
+		}
+		flags |= 0x02
+	}
 
-	return &TStatZoneConfig{
-		CurrentTemp:     params.Z4CurrentTemp,
-		CurrentHumidity: params.Z4CurrentHumidity,
-		OutdoorTemp:     params.OutdoorAirTemp,
-		Mode:            rawModeToString(params.Mode & 0xf),
-		Stage:           params.Mode >> 5,
-		FanMode:         rawFanModeToString(cfg.Z4FanMode),
-		Hold:            hold,
-		HeatSetpoint:    cfg.Z4HeatSetpoint,
-		CoolSetpoint:    cfg.Z4CoolSetpoint,
-		RawMode:         params.Mode,
-	}, true
+	if args.HeatSetpoint != nil {
+		params.HeatSetpoint[z] = rawTemp(*args.HeatSetpoint)
+		flags |= 0x04
+	}
+
+	if args.CoolSetpoint != nil {
+		params.CoolSetpoint[z] = rawTemp(*args.CoolSetpoint)
+		flags |= 0x08
+	}
+
+	// checked against the zone's current setpoints when only one changes
+	if flags&0x0c != 0 && params.HeatSetpoint[z] >= params.CoolSetpoint[z] {
+		return false, fmt.Errorf("heatSetpoint %d must be below coolSetpoint %d",
+			params.HeatSetpoint[z], params.CoolSetpoint[z])
+	}
+
+	if args.HumidifySetpoint > 0 {
+		params.TargetHumidity[z] = args.HumidifySetpoint
+		flags |= 0x10
+	}
+
+	if flags != 0 {
+		log.Printf("calling doWrite with flags: %x", flags)
+		if ok, err := writeTable(devTSTAT, params, flags); !ok {
+			return false, err
+		}
+	}
+
+	if args.DehumidifySetpoint > 0 {
+		hum := TStatHumidityParams{}
+		if !infinity.ReadTable(devTSTAT, &hum) {
+			return false, nil
+		}
+		hum.DehumidifySetpoint[z] = args.DehumidifySetpoint
+		if ok, err := writeTable(devTSTAT, hum, 0x01); !ok {
+			return false, err
+		}
+	}
+
+	if len(args.Mode) > 0 {
+		mode, _ := stringModeToRaw(args.Mode)
+		p := TStatCurrentParams{Mode: mode}
+		if ok, err := writeTable(devTSTAT, p, 0x10); !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
 }
 
-func getTstatSettings() (*TStatSettings, bool) {
+func getTstatSettings(priority actionPriority) (*APITStatSettings, bool) {
 	tss := TStatSettings{}
-	ok := infinity.ReadTable(devTSTAT, &tss)
+	ok := infinity.ReadTablePriority(devTSTAT, &tss, priority)
 	if !ok {
 		return nil, false
 	}
 
-	return &TStatSettings{
-		BacklightSetting: tss.BacklightSetting,
-		AutoMode:         tss.AutoMode,
-		DeadBand:         tss.DeadBand,
-		CyclesPerHour:    tss.CyclesPerHour,
-		SchedulePeriods:  tss.SchedulePeriods,
-		ProgramsEnabled:  tss.ProgramsEnabled,
-		TempUnits:        tss.TempUnits,
-		DealerName:       tss.DealerName,
-		DealerPhone:      tss.DealerPhone,
-	}, true
+	setTstatUnits(tss.TempUnits)
+
+	api := tss.toAPI()
+	return &api, true
 }
 
 func getAirHandler() (AirHandler, bool) {
-	b := cache.get("blower")
-	tb, ok := b.(*AirHandler)
-	if !ok {
-		return AirHandler{}, false
-	}
-	return *tb, true
+	return getSection(state, &state.airHandler)
 }
 
 func getHeatPump() (HeatPump, bool) {
-	h := cache.get("heatpump")
-	th, ok := h.(*HeatPump)
-	if !ok {
-		return HeatPump{}, false
-	}
-	return *th, true
+	return getSection(state, &state.heatPump)
 }
 
-func statePoller() {
-	for {
-		// called once for all zones
-		c1, ok := getZ1Config()
-		if ok {
-			cache.update("tstat", c1)
-		}
-		time.Sleep(time.Second * 1)
-	}
+func getDampers() (Dampers, bool) {
+	return getSection(state, &state.dampers)
 }
 
 func attachSnoops() {
@@ -287,19 +493,87 @@ func attachSnoops() {
 		heatPump, ok := getHeatPump()
 		if ok {
 			if bytes.Equal(frame.data[0:3], []byte{0x00, 0x3e, 0x01}) {
-				heatPump.CoilTemp = float32(binary.BigEndian.Uint16(data[2:4])) / float32(16)
-				heatPump.OutsideTemp = float32(binary.BigEndian.Uint16(data[0:2])) / float32(16)
-				log.Debugf("heat pump coil temp is: %f", heatPump.CoilTemp)
-				log.Debugf("heat pump outside temp is: %f", heatPump.OutsideTemp)
-				cache.update("heatpump", &heatPump)
+				heatPumpDetected.Store(true)
+				heatPump.CoilTemp = sensorTemp16(int16(binary.BigEndian.Uint16(data[2:4])))
+				heatPump.OutsideTemp = sensorTemp16(int16(binary.BigEndian.Uint16(data[0:2])))
+				if heatPump.CoilTemp != nil {
+					log.Debugf("heat pump coil temp is: %f", *heatPump.CoilTemp)
+				} else {
+					log.Debug("heat pump coil temp sensor fault")
+				}
+				if heatPump.OutsideTemp != nil {
+					log.Debugf("heat pump outside temp is: %f", *heatPump.OutsideTemp)
+				} else {
+					log.Debug("heat pump outside temp sensor fault")
+				}
+				if len(data) >= 8 {
+					heatPump.DischargeTemp = sensorTemp16(int16(binary.BigEndian.Uint16(data[4:6])))
+					heatPump.SuctionTemp = sensorTemp16(int16(binary.BigEndian.Uint16(data[6:8])))
+				}
+				setSection(state, &state.heatPump, heatPump, sourceSnooped)
 			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x3e, 0x02}) {
 				heatPump.Stage = data[0] >> 1
+				heatPump.CompressorOn = heatPump.Stage > 0
 				log.Debugf("HP stage is: %d", heatPump.Stage)
-				cache.update("heatpump", &heatPump)
+				if len(data) >= 5 {
+					defrost := data[1]&0x02 != 0
+					if heatPump.Defrost && !defrost {
+						now := time.Now()
+						heatPump.LastDefrost = &now
+						log.Debug("HP defrost finished")
+					}
+					heatPump.Defrost = defrost
+					heatPump.ReversingValve = rawReversingValveToString(data[1] & 0x01)
+					heatPump.CompressorRPM = binary.BigEndian.Uint16(data[2:4])
+					heatPump.FaultCode = data[4]
+				}
+				setSection(state, &state.heatPump, heatPump, sourceSnooped)
+			}
+		}
+	})
+
+	// Snoop Damper Control Module responses.  Systems with more than four
+	// zones have a second module; each reports 0xff for zones it doesn't
+	// control.
+	infinity.snoopResponse(0x6000, 0x61ff, func(frame *InfinityFrame) {
+		data := frame.data[3:]
+		if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x19}) && len(data) >= 2*maxZones {
+			dampers, _ := getDampers()
+			for z := 0; z < maxZones; z++ {
+				if data[z] != 0xff {
+					dampers.Position[z] = data[z]
+				}
+				if data[maxZones+z] != 0xff {
+					dampers.AirflowShare[z] = data[maxZones+z]
+				}
+			}
+			log.Debugf("damper positions are: %v", dampers.Position)
+			setSection(state, &state.dampers, dampers, sourceSnooped)
+		}
+	})
+
+	// Snoop Remote Room Sensor responses
+	infinity.snoopResponse(0x3000, 0x31ff, func(frame *InfinityFrame) {
+		data := frame.data[3:]
+		if bytes.Equal(frame.data[0:3], []byte{0x00, 0x3c, 0x01}) && len(data) >= 4 {
+			sensor := RemoteSensor{
+				Address: fmt.Sprintf("%04x", frame.src),
+				Temp:    sensorTemp16(int16(binary.BigEndian.Uint16(data[0:2]))),
+				Zone:    data[3],
 			}
+			if data[2] != 0xff {
+				humidity := data[2]
+				sensor.Humidity = &humidity
+			}
+			log.Debugf("remote sensor %s reading: %+v", sensor.Address, sensor)
+			updateRemoteSensor(sensor)
 		}
 	})
 
+	// Decode the thermostat's writes to the SAM and answer its reads
+	infinity.snoopSAMWrite(recordSAMWrite)
+	infinity.answerSAMReads(samTable)
+
 	// Snoop Air Handler responses
 	infinity.snoopResponse(0x4000, 0x42ff, func(frame *InfinityFrame) {
 		data := frame.data[3:]
@@ -308,12 +582,27 @@ func attachSnoops() {
 			if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x06}) {
 				airHandler.BlowerRPM = binary.BigEndian.Uint16(data[1:5])
 				log.Debugf("blower RPM is: %d", airHandler.BlowerRPM)
-				cache.update("blower", &airHandler)
-			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x16}) {
-				airHandler.AirFlowCFM = binary.BigEndian.Uint16(data[4:8])
-				airHandler.ElecHeat = data[0]&0x03 != 0
+				recordBlower(time.Now(), airHandler.BlowerRPM, airHandler.AirFlowCFM)
+				setSection(state, &state.airHandler, airHandler, sourceSnooped)
+			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x16}) && len(data) >= 6 {
+				airHandler.AirFlowCFM = binary.BigEndian.Uint16(data[4:6])
+				airHandler.ElecHeatStage = data[0] & 0x03
+				airHandler.ElecHeat = airHandler.ElecHeatStage != 0
 				log.Debugf("air flow CFM is: %d", airHandler.AirFlowCFM)
-				cache.update("blower", &airHandler)
+				if len(data) >= 14 {
+					airHandler.StaticPressure = float32(binary.BigEndian.Uint16(data[6:8])) / float32(100)
+					airHandler.TargetCFM = binary.BigEndian.Uint16(data[12:14])
+					log.Debugf("target air flow CFM is: %d", airHandler.TargetCFM)
+				}
+				setSection(state, &state.airHandler, airHandler, sourceSnooped)
+			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x08}) && len(data) >= 5 {
+				airHandler.HeatStage = data[0]
+				airHandler.Inducer = rawInducerToString(data[1])
+				airHandler.InducerRPM = binary.BigEndian.Uint16(data[2:4])
+				airHandler.FlameSensed = data[4]&0x01 != 0
+				airHandler.GasValve = data[4]&0x02 != 0
+				log.Debugf("furnace heat stage is: %d", airHandler.HeatStage)
+				setSection(state, &state.airHandler, airHandler, sourceSnooped)
 			}
 		}
 	})
@@ -323,9 +612,36 @@ func attachSnoops() {
 func main() {
 	httpPort := flag.Int("httpport", 8080, "HTTP port to listen on")
 	serialPort := flag.String("serial", "", "path to serial port")
+	flag.DurationVar(&clockSyncInterval, "timesync", 0, "interval to check and correct the thermostat clock, 0 disables")
+	flag.DurationVar(&clockSyncThreshold, "timesync-threshold", clockSyncThreshold, "clock drift allowed before the thermostat clock is corrected")
+	flag.DurationVar(&faultCheckInterval, "faultcheck", faultCheckInterval, "interval between fault history checks")
+	flag.Float64Var(&filterLifeHours, "filter-hours", filterLifeHours, "blower run time in hours before a filter is used up")
+	flag.StringVar(&maintenanceFile, "maintenance-file", "", "file to keep blower filter usage in across restarts")
+	flag.Var(durationsFlag{pollIntervals, pollNames}, "poll", "comma separated table=interval list of how often to poll thermostat tables, 0 disables")
+	flag.BoolVar(&verifyWrites, "verify-writes", false, "read tables back after writing them to check the write took effect")
+	flag.Var(durationsFlag{sectionMaxAge, sectionNames}, "max-age", "comma separated section=duration list of how long data may go without refreshing before it is stale")
+	flag.Var(addrFlag{&devTSTAT}, "tstat", "hex bus address of the thermostat to read and write")
+	flag.Var(addrFlag{&devSAM}, "sam", "hex bus address of the SAM to impersonate")
+	flag.StringVar(&samConfigFile, "sam-config", "", "JSON file with the identification and tables to answer the thermostat's reads of the SAM with")
+	flag.StringVar(&unitsOverride, "units", "", "default temperature units (F or C), defaults to the thermostat's setting")
 
 	flag.Parse()
 
+	if len(unitsOverride) > 0 {
+		if _, ok := parseUnits(unitsOverride); !ok {
+			fmt.Print("units must be F or C\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if len(samConfigFile) > 0 {
+		if err := loadSAMConfig(); err != nil {
+			fmt.Printf("error loading SAM config: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	if len(*serialPort) == 0 {
 		fmt.Print("must provide serial\n")
 		flag.PrintDefaults()
@@ -334,17 +650,31 @@ func main() {
 
 	log.SetLevel(log.DebugLevel)
 
+	if len(maintenanceFile) > 0 {
+		loadBlowerFilter()
+	} else {
+		resetBlowerFilter()
+	}
+
 	infinity = &InfinityProtocol{device: *serialPort}
-	airHandler := new(AirHandler)
-	heatPump := new(HeatPump)
-	cache.update("blower", airHandler)
-	cache.update("heatpump", heatPump)
+	state.setMaxAges()
+	seedSection(state, &state.airHandler, AirHandler{Inducer: "unknown"})
+	seedSection(state, &state.heatPump, HeatPump{ReversingValve: "unknown"})
 	attachSnoops()
 	err := infinity.Open()
 	if err != nil {
 		log.Panicf("error opening serial port: %s", err.Error())
 	}
 
-	go statePoller()
+	go poller()
+	go staleWatcher()
+	go vacationPlanner()
+	go faultWatcher()
+	if len(maintenanceFile) > 0 {
+		go maintenanceSaver()
+	}
+	if clockSyncInterval > 0 {
+		go clockSyncer()
+	}
 	webserver(*httpPort)
 }
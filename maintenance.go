@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Blower run time allowed on a filter before it's considered used up and
+// the file the blower filter counters are saved to, set from the command
+// line.  Without a file the counters start over whenever infinitive does.
+var (
+	filterLifeHours     = 500.0
+	maintenanceFile     string
+	maintenanceSaveTime = 10 * time.Minute
+)
+
+// Gaps between blower samples longer than this aren't counted, so a quiet
+// bus doesn't turn into run time.
+const maxBlowerSampleGap = time.Minute
+
+// blowerFilter is infinitive's own filter usage estimate based on snooped
+// blower run time and air flow.
+type blowerFilter struct {
+	BlowerHours float64   `json:"blowerHours"`
+	AirVolume   float64   `json:"airVolume"` // cubic feet
+	LastReset   time.Time `json:"lastReset"`
+}
+
+var (
+	filter        blowerFilter
+	filterMutex   = &sync.Mutex{}
+	filterSample  time.Time
+	filterRunning bool
+	filterCFM     uint16
+
+	// serializes writes of the maintenance file
+	filterSaveMutex = &sync.Mutex{}
+)
+
+type APIMaintenanceItem struct {
+	Usage    uint8 `json:"usage"` // percent
+	Reminder bool  `json:"reminder"`
+}
+
+type APIBlowerFilter struct {
+	BlowerHours float64 `json:"blowerHours"`
+	AirVolume   float64 `json:"airVolume"`
+	Usage       float64 `json:"usage"`
+	LastReset   string  `json:"lastReset"`
+}
+
+type APIMaintenance struct {
+	Filter           APIMaintenanceItem `json:"filter"`
+	UVLamp           APIMaintenanceItem `json:"uvLamp"`
+	HumidifierPad    APIMaintenanceItem `json:"humidifierPad"`
+	VentilatorFilter APIMaintenanceItem `json:"ventilatorFilter"`
+	BlowerFilter     APIBlowerFilter    `json:"blowerFilter"`
+}
+
+// maintenanceItems maps the item names used by the API to their usage write
+// flag, which is also their reminder bit.
+var maintenanceItems = map[string]uint8{
+	"filter":           0x01,
+	"uvLamp":           0x02,
+	"humidifierPad":    0x04,
+	"ventilatorFilter": 0x08,
+}
+
+// recordBlower accumulates blower run time and air volume from air handler
+// snoops.
+func recordBlower(now time.Time, rpm uint16, cfm uint16) {
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+
+	if filterRunning && !filterSample.IsZero() {
+		elapsed := now.Sub(filterSample)
+		if elapsed > 0 && elapsed <= maxBlowerSampleGap {
+			filter.BlowerHours += elapsed.Hours()
+			filter.AirVolume += float64(filterCFM) * elapsed.Minutes()
+		}
+	}
+
+	filterSample = now
+	filterRunning = rpm > 0
+	filterCFM = cfm
+}
+
+// saveBlowerFilter writes the counters to the maintenance file.  It mustn't
+// be called with filterMutex held, or from the serial reader, since slow
+// storage would hold up the bus.
+func saveBlowerFilter() {
+	filterSaveMutex.Lock()
+	defer filterSaveMutex.Unlock()
+
+	filterMutex.Lock()
+	buf, _ := json.Marshal(&filter)
+	filterMutex.Unlock()
+
+	if err := os.WriteFile(maintenanceFile, buf, 0644); err != nil {
+		log.Errorf("error saving maintenance file: %s", err.Error())
+	}
+}
+
+// maintenanceSaver periodically saves the blower filter counters so they
+// survive a restart.
+func maintenanceSaver() {
+	for range time.Tick(maintenanceSaveTime) {
+		saveBlowerFilter()
+	}
+}
+
+func loadBlowerFilter() {
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+
+	buf, err := os.ReadFile(maintenanceFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("error reading maintenance file: %s", err.Error())
+		}
+		filter.LastReset = time.Now()
+		return
+	}
+
+	if err := json.Unmarshal(buf, &filter); err != nil {
+		log.Errorf("error parsing maintenance file: %s", err.Error())
+	}
+}
+
+func getBlowerFilter() APIBlowerFilter {
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+
+	api := APIBlowerFilter{
+		BlowerHours: filter.BlowerHours,
+		AirVolume:   filter.AirVolume,
+		LastReset:   filter.LastReset.Format(time.RFC3339),
+	}
+	if filterLifeHours > 0 {
+		api.Usage = filter.BlowerHours / filterLifeHours * 100
+	}
+	return api
+}
+
+func resetBlowerFilter() {
+	filterMutex.Lock()
+	filter = blowerFilter{LastReset: time.Now()}
+	filterMutex.Unlock()
+
+	if len(maintenanceFile) > 0 {
+		saveBlowerFilter()
+	}
+}
+
+func (params TStatMaintenance) item(usage uint8, bit uint8) APIMaintenanceItem {
+	return APIMaintenanceItem{Usage: usage, Reminder: params.Reminders&bit != 0}
+}
+
+func getMaintenance() (*APIMaintenance, bool) {
+	params := TStatMaintenance{}
+	ok := infinity.ReadTable(devTSTAT, &params)
+	if !ok {
+		return nil, false
+	}
+
+	return &APIMaintenance{
+		Filter:           params.item(params.FilterUsage, 0x01),
+		UVLamp:           params.item(params.UVLampUsage, 0x02),
+		HumidifierPad:    params.item(params.HumidifierPadUsage, 0x04),
+		VentilatorFilter: params.item(params.VentilatorFilterUsage, 0x08),
+		BlowerFilter:     getBlowerFilter(),
+	}, true
+}
+
+// resetMaintenance resets the usage and clears the reminder of an item after
+// service.  Resetting the filter also resets infinitive's blower filter
+// counters.
+func resetMaintenance(item string) (bool, error) {
+	if item == "blowerFilter" {
+		resetBlowerFilter()
+		return true, nil
+	}
+
+	bit, ok := maintenanceItems[item]
+	if !ok {
+		return false, errors.New("unknown maintenance item: " + item)
+	}
+
+	params := TStatMaintenance{}
+	if !infinity.ReadTable(devTSTAT, &params) {
+		return false, nil
+	}
+
+	switch bit {
+	case 0x01:
+		params.FilterUsage = 0
+	case 0x02:
+		params.UVLampUsage = 0
+	case 0x04:
+		params.HumidifierPadUsage = 0
+	case 0x08:
+		params.VentilatorFilterUsage = 0
+	}
+	params.Reminders &^= bit
+
+	if ok, err := writeTable(devTSTAT, params, bit|0x10); !ok {
+		return false, err
+	}
+
+	if item == "filter" {
+		resetBlowerFilter()
+	}
+	return true, nil
+}
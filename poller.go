@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often each group of thermostat tables is polled, settable with
+// -poll.  An interval of 0 only polls after a write.
+var pollIntervals = map[string]time.Duration{
+	"zones":    5 * time.Second,
+	"settings": time.Hour,
+	"schedule": 24 * time.Hour,
+	"devices":  5 * time.Second,
+}
+
+const (
+	// polls are spread by up to this fraction of their interval so they
+	// don't line up
+	pollJitter = 0.1
+
+	// a failed poll is retried after pollRetry, doubling on every further
+	// failure up to pollMaxBackoff
+	pollRetry      = 5 * time.Second
+	pollMaxBackoff = 5 * time.Minute
+)
+
+type pollTask struct {
+	name     string
+	sections []string // state sections refreshed by the poll
+	poll     func() bool
+	interval time.Duration
+	next     time.Time // zero when not scheduled
+	failures int
+}
+
+var pollTasks = []*pollTask{
+	{name: "zones", sections: []string{"tstat", "zones"}, poll: func() bool {
+		_, ok := refreshZoneTables(priorityPoll)
+		return ok
+	}},
+	// also keeps track of the thermostat's display units for the API default
+	{name: "settings", sections: []string{"settings"}, poll: func() bool {
+		return refreshSettings(priorityPoll)
+	}},
+	{name: "schedule", sections: []string{"schedule"}, poll: func() bool {
+		return refreshSchedule(priorityPoll)
+	}},
+	{name: "devices", sections: []string{"devices"}, poll: func() bool {
+		identifyOutdoorUnits(time.Now())
+		setSection(state, &state.devices, stateDevices(), sourcePolled)
+		return true
+	}},
+}
+
+var pollRequests = make(chan string, 16)
+
+func pollNames() []string {
+	names := []string{}
+	for _, t := range pollTasks {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// sectionPollInterval returns the interval of the poll that refreshes a
+// state section, if it is polled.
+func sectionPollInterval(section string) (time.Duration, bool) {
+	for _, t := range pollTasks {
+		for _, s := range t.sections {
+			if s == section {
+				return pollIntervals[t.name], true
+			}
+		}
+	}
+	return 0, false
+}
+
+// pollNow asks the poller to refresh a group of tables straight away,
+// e.g. after writing to them.
+func pollNow(name string) {
+	select {
+	case pollRequests <- name:
+	default:
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*pollJitter*float64(d))
+}
+
+// reschedule sets the time of the next poll.  Failures back off since the
+// bus is likely unhealthy.
+func (t *pollTask) reschedule(now time.Time, ok bool) {
+	if ok {
+		t.failures = 0
+		if t.interval > 0 {
+			t.next = now.Add(jitter(t.interval))
+		} else {
+			t.next = time.Time{}
+		}
+		return
+	}
+
+	t.failures++
+	t.next = now.Add(jitter(retryBackoff(t.failures)))
+	log.Warnf("polling %s failed %d times, retrying in %s", t.name, t.failures, t.next.Sub(now).Round(time.Second))
+}
+
+// retryBackoff returns how long to wait after the given number of
+// consecutive failures.
+func retryBackoff(failures int) time.Duration {
+	if failures >= 8 {
+		return pollMaxBackoff
+	}
+	backoff := pollRetry << (failures - 1)
+	if backoff > pollMaxBackoff {
+		backoff = pollMaxBackoff
+	}
+	return backoff
+}
+
+func poller() {
+	now := time.Now()
+	for _, t := range pollTasks {
+		t.interval = pollIntervals[t.name]
+		if t.interval > 0 {
+			t.next = now
+		}
+	}
+
+	for {
+		now = time.Now()
+		for _, t := range pollTasks {
+			if !t.next.IsZero() && !now.Before(t.next) {
+				t.reschedule(time.Now(), t.poll())
+			}
+		}
+
+		wait := time.Minute
+		now = time.Now()
+		for _, t := range pollTasks {
+			if !t.next.IsZero() && t.next.Sub(now) < wait {
+				wait = t.next.Sub(now)
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case name := <-pollRequests:
+			for _, t := range pollTasks {
+				if t.name == name {
+					t.next = time.Now()
+				}
+			}
+		}
+	}
+}
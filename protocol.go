@@ -3,17 +3,44 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/tarm/serial"
 )
 
-const (
+// Addresses of the thermostat Infinitive reads and writes, and of the SAM
+// it impersonates.  Set from the command line for systems where they
+// differ.
+var (
 	devTSTAT = uint16(0x2001)
 	devSAM   = uint16(0x9201)
 )
 
+// addrFlag parses a 4 character hex bus address.
+type addrFlag struct {
+	addr *uint16
+}
+
+func (f addrFlag) String() string {
+	if f.addr == nil {
+		return ""
+	}
+	return fmt.Sprintf("%04x", *f.addr)
+}
+
+func (f addrFlag) Set(value string) error {
+	addr, err := strconv.ParseUint(value, 16, 16)
+	if err != nil || len(value) != 4 {
+		return fmt.Errorf("address must be a 4 character hex string")
+	}
+	*f.addr = uint16(addr)
+	return nil
+}
+
 const responseTimeout = 200
 const responseRetries = 5
 
@@ -33,8 +60,33 @@ type InfinityProtocol struct {
 	device     string
 	port       *serial.Port
 	responseCh chan *InfinityFrame
-	actionCh   chan *Action
+	actions    actionQueue
 	snoops     []InfinityProtocolSnoop
+	samWrites  []snoopCallback
+	samTables  func(InfinityTableAddr) ([]byte, bool)
+	devices    map[uint16]time.Time
+	devMutex   sync.Mutex
+}
+
+// Bus actions are performed highest priority first, and in the order they
+// were queued within a priority.
+type actionPriority int
+
+const (
+	priorityPoll  actionPriority = iota // background polling
+	priorityRead                        // reads for API requests
+	priorityWrite                       // writes
+)
+
+func (pri actionPriority) String() string {
+	switch pri {
+	case priorityPoll:
+		return "poll"
+	case priorityRead:
+		return "read"
+	default:
+		return "write"
+	}
 }
 
 type Action struct {
@@ -42,6 +94,122 @@ type Action struct {
 	responseFrame *InfinityFrame
 	ok            bool
 	ch            chan bool
+	priority      actionPriority
+	seq           uint64
+	dups          []*Action // identical reads answered along with this one
+}
+
+// actionQueue holds the actions waiting for the broker.
+type actionQueue struct {
+	mutex   sync.Mutex
+	pending []*Action
+	seq     uint64
+	signal  chan struct{}
+
+	performed    uint64
+	deduplicated uint64
+	timedOut     uint64
+}
+
+type APIBusDiagnostics struct {
+	QueueDepth       int            `json:"queueDepth"`
+	QueuedByPriority map[string]int `json:"queuedByPriority"`
+	Performed        uint64         `json:"performed"`
+	Deduplicated     uint64         `json:"deduplicated"`
+	TimedOut         uint64         `json:"timedOut"`
+}
+
+// push queues an action.  A read identical to one already waiting is
+// answered along with it instead, raising the waiting read's priority if
+// needed.
+func (q *actionQueue) push(action *Action) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	req := action.requestFrame
+	if req.op == opREAD {
+		for _, a := range q.pending {
+			if a.requestFrame.op == opREAD && a.requestFrame.dst == req.dst && bytes.Equal(a.requestFrame.data, req.data) {
+				a.dups = append(a.dups, action)
+				if action.priority > a.priority {
+					a.priority = action.priority
+				}
+				q.deduplicated++
+				return
+			}
+		}
+	}
+
+	q.seq++
+	action.seq = q.seq
+	q.pending = append(q.pending, action)
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next action to perform, or returns nil if there are none.
+func (q *actionQueue) pop() *Action {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+
+	next := 0
+	for i, a := range q.pending {
+		n := q.pending[next]
+		if a.priority > n.priority || (a.priority == n.priority && a.seq < n.seq) {
+			next = i
+		}
+	}
+
+	action := q.pending[next]
+	q.pending = append(q.pending[:next], q.pending[next+1:]...)
+	return action
+}
+
+// done records the outcome of an action and passes it to everyone waiting
+// on it.
+func (q *actionQueue) done(action *Action, ok bool) {
+	q.mutex.Lock()
+	q.performed++
+	if !ok {
+		q.timedOut++
+	}
+	q.mutex.Unlock()
+
+	action.ok = ok
+	for _, dup := range action.dups {
+		dup.responseFrame = action.responseFrame
+		dup.ok = ok
+		dup.ch <- ok
+	}
+	action.ch <- ok
+}
+
+func (q *actionQueue) diagnostics() APIBusDiagnostics {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	d := APIBusDiagnostics{
+		QueueDepth:       len(q.pending),
+		QueuedByPriority: map[string]int{},
+		Performed:        q.performed,
+		Deduplicated:     q.deduplicated,
+		TimedOut:         q.timedOut,
+	}
+	for _, pri := range []actionPriority{priorityPoll, priorityRead, priorityWrite} {
+		d.QueuedByPriority[pri.String()] = 0
+	}
+	for _, a := range q.pending {
+		d.QueuedByPriority[a.priority.String()] += 1 + len(a.dups)
+		d.QueueDepth += len(a.dups)
+	}
+	return d
 }
 
 var readTimeout = time.Second * 5
@@ -69,7 +237,7 @@ func (p *InfinityProtocol) Open() error {
 	}
 
 	p.responseCh = make(chan *InfinityFrame, 32)
-	p.actionCh = make(chan *Action)
+	p.actions.signal = make(chan struct{}, 1)
 
 	go p.reader()
 	go p.broker()
@@ -80,6 +248,8 @@ func (p *InfinityProtocol) Open() error {
 func (p *InfinityProtocol) handleFrame(frame *InfinityFrame) *InfinityFrame {
 	// log.Printf("read frame: %s", frame)
 
+	p.deviceSeen(frame.src)
+
 	switch frame.op {
 	case opRESPONSE:
 		if frame.dst == devSAM {
@@ -93,9 +263,24 @@ func (p *InfinityProtocol) handleFrame(frame *InfinityFrame) *InfinityFrame {
 				}
 			}
 		}
+	case opREAD:
+		if isThermostat(frame.src) && frame.dst == devSAM && p.samTables != nil && len(frame.data) >= 3 {
+			var addr InfinityTableAddr
+			copy(addr[:], frame.data[0:3])
+			if data, ok := p.samTables(addr); ok {
+				// same layout as the responses we get: the table address,
+				// three bytes we don't know the meaning of, then the table
+				res := append(addr[:], 0x00, 0x00, 0x00)
+				return &InfinityFrame{src: frame.dst, dst: frame.src, op: opRESPONSE, data: append(res, data...)}
+			}
+			log.Debugf("thermostat read SAM table %x which we can't answer", addr)
+		}
 	case opWRITE:
-		if frame.src == devTSTAT && frame.dst == devSAM {
-			return writeAck
+		if isThermostat(frame.src) && frame.dst == devSAM {
+			for _, cb := range p.samWrites {
+				cb(frame)
+			}
+			return frame.ack()
 		}
 	}
 
@@ -158,10 +343,14 @@ func (p *InfinityProtocol) broker() {
 	defer panic("exiting InfinityProtocol broker, this should never happen")
 
 	for {
+		if action := p.actions.pop(); action != nil {
+			p.performAction(action)
+			continue
+		}
+
 		// log.Debug("entering action select")
 		select {
-		case action := <-p.actionCh:
-			p.performAction(action)
+		case <-p.actions.signal:
 		case <-p.responseCh:
 			log.Warn("dropping unexpected response")
 		}
@@ -191,8 +380,7 @@ func (p *InfinityProtocol) performAction(action *Action) {
 			}
 			action.responseFrame = res
 			// log.Printf("got response!")
-			action.ok = true
-			action.ch <- true
+			p.actions.done(action, true)
 			// log.Printf("sent action!")
 			return
 		case <-ticker.C:
@@ -203,15 +391,20 @@ func (p *InfinityProtocol) performAction(action *Action) {
 	}
 
 	log.Printf("action timed out")
-	action.ch <- false
+	p.actions.done(action, false)
+}
+
+// Diagnostics reports the state of the action queue.
+func (p *InfinityProtocol) Diagnostics() APIBusDiagnostics {
+	return p.actions.diagnostics()
 }
 
-func (p *InfinityProtocol) send(dst uint16, op uint8, requestData []byte, response interface{}) bool {
+func (p *InfinityProtocol) send(dst uint16, op uint8, requestData []byte, response interface{}, priority actionPriority) bool {
 	f := InfinityFrame{src: devSAM, dst: dst, op: op, data: requestData}
-	act := &Action{requestFrame: &f, ch: make(chan bool)}
+	act := &Action{requestFrame: &f, ch: make(chan bool, 1), priority: priority}
 
-	// Send action to action handling goroutine
-	p.actionCh <- act
+	// Queue action for the action handling goroutine
+	p.actions.push(act)
 	// Wait for response
 	ok := <-act.ch
 
@@ -237,7 +430,7 @@ func (p *InfinityProtocol) Write(dst uint16, table []byte, addr []byte, params i
 	buf.Write(addr[:])
 	binary.Write(buf, binary.BigEndian, params)
 
-	return p.send(dst, opWRITE, buf.Bytes(), nil)
+	return p.send(dst, opWRITE, buf.Bytes(), nil, priorityWrite)
 }
 
 func (p *InfinityProtocol) WriteTable(dst uint16, table InfinityTable, flags uint8) bool {
@@ -247,12 +440,20 @@ func (p *InfinityProtocol) WriteTable(dst uint16, table InfinityTable, flags uin
 }
 
 func (p *InfinityProtocol) Read(dst uint16, addr InfinityTableAddr, params interface{}) bool {
-	return p.send(dst, opREAD, addr[:], params)
+	return p.ReadPriority(dst, addr, params, priorityRead)
+}
+
+func (p *InfinityProtocol) ReadPriority(dst uint16, addr InfinityTableAddr, params interface{}, priority actionPriority) bool {
+	return p.send(dst, opREAD, addr[:], params, priority)
 }
 
 func (p *InfinityProtocol) ReadTable(dst uint16, table InfinityTable) bool {
+	return p.ReadTablePriority(dst, table, priorityRead)
+}
+
+func (p *InfinityProtocol) ReadTablePriority(dst uint16, table InfinityTable, priority actionPriority) bool {
 	addr := table.addr()
-	return p.send(dst, opREAD, addr[:], table)
+	return p.send(dst, opREAD, addr[:], table, priority)
 }
 
 func (p *InfinityProtocol) sendFrame(buf []byte) bool {
@@ -276,3 +477,68 @@ func (p *InfinityProtocol) snoopResponse(srcMin uint16, srcMax uint16, cb snoopC
 	s := InfinityProtocolSnoop{srcMin: srcMin, srcMax: srcMax, cb: cb}
 	p.snoops = append(p.snoops, s)
 }
+
+// snoopSAMWrite registers a callback for thermostats' writes to the SAM.
+// They are acknowledged after the callbacks run.
+func (p *InfinityProtocol) snoopSAMWrite(cb snoopCallback) {
+	p.samWrites = append(p.samWrites, cb)
+}
+
+// answerSAMReads sets the function used to answer thermostats' reads of SAM
+// tables.  Reads it can't answer are ignored.
+func (p *InfinityProtocol) answerSAMReads(tables func(InfinityTableAddr) ([]byte, bool)) {
+	p.samTables = tables
+}
+
+// deviceSeen records that a device has transmitted on the bus.
+func (p *InfinityProtocol) deviceSeen(addr uint16) {
+	p.devMutex.Lock()
+	defer p.devMutex.Unlock()
+
+	if p.devices == nil {
+		p.devices = make(map[uint16]time.Time)
+	}
+	if _, ok := p.devices[addr]; !ok {
+		log.Infof("discovered device %04x", addr)
+	}
+	p.devices[addr] = time.Now()
+}
+
+// Devices returns the addresses of all devices seen on the bus along with
+// the time each was last heard from.
+func (p *InfinityProtocol) Devices() map[uint16]time.Time {
+	p.devMutex.Lock()
+	defer p.devMutex.Unlock()
+
+	devices := make(map[uint16]time.Time, len(p.devices))
+	for addr, t := range p.devices {
+		devices[addr] = t
+	}
+	return devices
+}
+
+// isThermostat reports whether addr is the thermostat Infinitive talks to or
+// any other thermostat, on systems with more than one.
+func isThermostat(addr uint16) bool {
+	return addr == devTSTAT || deviceClass(addr) == "thermostat"
+}
+
+// deviceClass names the kind of device at a bus address.
+func deviceClass(addr uint16) string {
+	switch {
+	case addr >= 0x2000 && addr <= 0x20ff:
+		return "thermostat"
+	case addr >= 0x3000 && addr <= 0x31ff:
+		return "sensor"
+	case addr >= 0x4000 && addr <= 0x42ff:
+		return "indoor"
+	case addr >= 0x5000 && addr <= 0x51ff:
+		return "outdoor"
+	case addr >= 0x6000 && addr <= 0x61ff:
+		return "damper"
+	case addr >= 0x9200 && addr <= 0x92ff:
+		return "sam"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func testAction(op uint8, dst uint16, table byte, priority actionPriority) *Action {
+	return &Action{
+		requestFrame: &InfinityFrame{dst: dst, op: op, data: []byte{0x00, 0x3b, table}},
+		ch:           make(chan bool, 1),
+		priority:     priority,
+	}
+}
+
+func TestActionQueueOrder(t *testing.T) {
+	q := actionQueue{}
+	poll := testAction(opREAD, 0x2001, 0x02, priorityPoll)
+	read1 := testAction(opREAD, 0x2001, 0x03, priorityRead)
+	write := testAction(opWRITE, 0x2001, 0x03, priorityWrite)
+	read2 := testAction(opREAD, 0x2001, 0x04, priorityRead)
+
+	for _, a := range []*Action{poll, read1, write, read2} {
+		q.push(a)
+	}
+
+	for i, want := range []*Action{write, read1, read2, poll} {
+		if got := q.pop(); got != want {
+			t.Fatalf("pop %d: got table %x, want %x", i, got.requestFrame.data[2], want.requestFrame.data[2])
+		}
+	}
+	if a := q.pop(); a != nil {
+		t.Fatalf("pop from empty queue returned %v", a)
+	}
+}
+
+func TestActionQueueDedup(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    *Action
+		second   *Action
+		merged   bool
+		priority actionPriority
+	}{
+		{"same read", testAction(opREAD, 0x2001, 0x03, priorityPoll), testAction(opREAD, 0x2001, 0x03, priorityPoll), true, priorityPoll},
+		{"raises priority", testAction(opREAD, 0x2001, 0x03, priorityPoll), testAction(opREAD, 0x2001, 0x03, priorityRead), true, priorityRead},
+		{"keeps priority", testAction(opREAD, 0x2001, 0x03, priorityRead), testAction(opREAD, 0x2001, 0x03, priorityPoll), true, priorityRead},
+		{"other table", testAction(opREAD, 0x2001, 0x03, priorityPoll), testAction(opREAD, 0x2001, 0x04, priorityPoll), false, priorityPoll},
+		{"other device", testAction(opREAD, 0x2001, 0x03, priorityPoll), testAction(opREAD, 0x4001, 0x03, priorityPoll), false, priorityPoll},
+		{"writes", testAction(opWRITE, 0x2001, 0x03, priorityWrite), testAction(opWRITE, 0x2001, 0x03, priorityWrite), false, priorityWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := actionQueue{}
+			q.push(tt.first)
+			q.push(tt.second)
+
+			d := q.diagnostics()
+			if d.QueueDepth != 2 {
+				t.Errorf("queue depth %d, want 2", d.QueueDepth)
+			}
+			if merged := d.Deduplicated == 1; merged != tt.merged {
+				t.Fatalf("merged %v, want %v", merged, tt.merged)
+			}
+			if !tt.merged {
+				return
+			}
+
+			a := q.pop()
+			if a != tt.first || a.priority != tt.priority {
+				t.Fatalf("popped priority %s, want %s", a.priority, tt.priority)
+			}
+			if q.pop() != nil {
+				t.Fatal("duplicate read was queued")
+			}
+
+			a.responseFrame = &InfinityFrame{op: opRESPONSE}
+			q.done(a, true)
+			if ok := <-tt.second.ch; !ok || tt.second.responseFrame != a.responseFrame {
+				t.Error("duplicate read didn't get the response")
+			}
+			if ok := <-tt.first.ch; !ok {
+				t.Error("read didn't complete")
+			}
+		})
+	}
+}
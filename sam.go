@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A thermostat with a SAM keeps it up to date by writing it its own tables.
+// Every table written is kept, and the ones whose layout matches a
+// thermostat table Infinitive knows are decoded with it.
+type SAMTable struct {
+	Table   string      `json:"table"`
+	Flags   string      `json:"flags"`
+	Data    string      `json:"data"`
+	Decoded interface{} `json:"decoded,omitempty"`
+}
+
+// SAMTables are keyed by table address.
+type SAMTables map[string]SAMTable
+
+func (tables SAMTables) inUnits(u tempUnits) interface{} {
+	out := make(SAMTables, len(tables))
+	for k, t := range tables {
+		if t.Decoded != nil {
+			t.Decoded = convertUnits(t.Decoded, u)
+		}
+		out[k] = t
+	}
+	return out
+}
+
+// System status written by the thermostat, indexed by zone number minus one.
+type SAMStatus struct {
+	Mode            string             `json:"mode"`
+	Stage           uint8              `json:"stage"`
+	OutdoorTemp     *float64           `json:"outdoorTemp"`
+	CurrentTemp     [maxZones]*float64 `json:"currentTemp"`
+	CurrentHumidity [maxZones]uint8    `json:"currentHumidity"`
+}
+
+func (s SAMStatus) inUnits(u tempUnits) interface{} {
+	s.OutdoorTemp = u.optFromF(s.OutdoorTemp)
+	for z := range s.CurrentTemp {
+		s.CurrentTemp[z] = u.optFromF(s.CurrentTemp[z])
+	}
+	return s
+}
+
+// decodeTable reads data into table if it is long enough.
+func decodeTable(data []byte, table InfinityTable) bool {
+	if len(data) < binary.Size(table) {
+		return false
+	}
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, table) == nil
+}
+
+var samDecoders = map[InfinityTableAddr]func(data []byte) interface{}{
+	TStatCurrentParams{}.addr(): func(data []byte) interface{} {
+		params := TStatCurrentParams{}
+		if !decodeTable(data, &params) {
+			return nil
+		}
+		status := SAMStatus{
+			Mode:            rawModeToString(params.Mode & 0xf),
+			Stage:           params.Mode >> 5,
+			OutdoorTemp:     sensorTemp(params.OutdoorAirTemp),
+			CurrentHumidity: params.CurrentHumidity,
+		}
+		for z := range params.CurrentTemp {
+			status.CurrentTemp[z] = sensorTemp(params.CurrentTemp[z])
+		}
+		return status
+	},
+	TStatVacationParams{}.addr(): func(data []byte) interface{} {
+		params := TStatVacationParams{}
+		if !decodeTable(data, &params) {
+			return nil
+		}
+		return params.toAPI()
+	},
+	TStatSettings{}.addr(): func(data []byte) interface{} {
+		params := TStatSettings{}
+		if !decodeTable(data, &params) {
+			return nil
+		}
+		return params.toAPI()
+	},
+	TStatAccessories{}.addr(): func(data []byte) interface{} {
+		params := TStatAccessories{}
+		if !decodeTable(data, &params) {
+			return nil
+		}
+		return params.toAPI()
+	},
+}
+
+// recordSAMWrite stores a table the thermostat wrote to the SAM.  Writes
+// from other thermostats are only acknowledged.
+func recordSAMWrite(frame *InfinityFrame) {
+	if frame.src != devTSTAT || len(frame.data) < 6 {
+		return
+	}
+
+	var addr InfinityTableAddr
+	copy(addr[:], frame.data[0:3])
+	data := frame.data[6:]
+
+	table := SAMTable{
+		Table: hex.EncodeToString(addr[:]),
+		Flags: hex.EncodeToString(frame.data[3:6]),
+		Data:  hex.EncodeToString(data),
+	}
+	if decode, ok := samDecoders[addr]; ok {
+		table.Decoded = decode(data)
+	}
+	log.Debugf("thermostat wrote SAM table %s: %s", table.Table, table.Data)
+
+	current, _ := getSection(state, &state.sam)
+	tables := make(SAMTables, len(current)+1)
+	for k, v := range current {
+		tables[k] = v
+	}
+	tables[table.Table] = table
+
+	setSection(state, &state.sam, tables, sourceSnooped)
+}
+
+func getSAMTables() (SAMTables, bool) {
+	tables, ok := getSection(state, &state.sam)
+	if !ok {
+		return nil, false
+	}
+	return tables, true
+}
+
+// samConfigFile is set from the command line.
+var samConfigFile string
+
+// SAMConfig describes the SAM Infinitive presents itself as when the
+// thermostat reads from it.  Tables holds other tables to answer with,
+// both address and data in hex.
+type SAMConfig struct {
+	DeviceType      string            `json:"deviceType"`
+	SoftwareVersion string            `json:"softwareVersion"`
+	ModelNumber     string            `json:"modelNumber"`
+	SerialNumber    string            `json:"serialNumber"`
+	Tables          map[string]string `json:"tables"`
+}
+
+var samConfig = SAMConfig{
+	DeviceType:      "SYSTEM ACCESS MODULE",
+	SoftwareVersion: "INFINITIVE",
+	ModelNumber:     "SYSTXCCSAM01",
+	SerialNumber:    "0000A000000",
+}
+
+// tables answered from the config, built by loadSAMConfig
+var samConfigTables = make(map[InfinityTableAddr][]byte)
+
+// longest table that fits in a frame after the address and flags
+const maxSAMTableLen = 255 - 6
+
+func loadSAMConfig() error {
+	buf, err := os.ReadFile(samConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, &samConfig); err != nil {
+		return err
+	}
+
+	for name, data := range samConfig.Tables {
+		a, err := hex.DecodeString(name)
+		if err != nil || len(a) < 2 || len(a) > 3 {
+			return fmt.Errorf("invalid table address %q", name)
+		}
+		var addr InfinityTableAddr
+		copy(addr[3-len(a):], a)
+
+		d, err := hex.DecodeString(data)
+		if err != nil || len(d) > maxSAMTableLen {
+			return fmt.Errorf("invalid data for table %s", name)
+		}
+		samConfigTables[addr] = d
+	}
+	return nil
+}
+
+// samTable returns the data to answer a thermostat read of a SAM table
+// with: a table from the config, the SAM's identification, or else the
+// table as the thermostat last wrote it.
+func samTable(addr InfinityTableAddr) ([]byte, bool) {
+	if data, ok := samConfigTables[addr]; ok {
+		return data, true
+	}
+
+	if addr == (DeviceInfo{}).addr() {
+		info := DeviceInfo{}
+		copy(info.DeviceType[:], samConfig.DeviceType)
+		copy(info.SoftwareVersion[:], samConfig.SoftwareVersion)
+		copy(info.ModelNumber[:], samConfig.ModelNumber)
+		copy(info.SerialNumber[:], samConfig.SerialNumber)
+
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, info)
+		return buf.Bytes(), true
+	}
+
+	tables, _ := getSAMTables()
+	if table, ok := tables[hex.EncodeToString(addr[:])]; ok {
+		data, _ := hex.DecodeString(table.Data)
+		return data, true
+	}
+	return nil, false
+}
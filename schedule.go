@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Setpoint limits accepted by the thermostat, in degrees F.
+const (
+	minHeatSetpoint = 40
+	maxHeatSetpoint = 90
+	minCoolSetpoint = 45
+	maxCoolSetpoint = 99
+)
+
+var scheduleDayNames = [scheduleDays]string{
+	"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday",
+}
+
+type APISchedulePeriod struct {
+	Start        string  `json:"start"`
+	HeatSetpoint float64 `json:"heatSetpoint"`
+	CoolSetpoint float64 `json:"coolSetpoint"`
+	FanMode      string  `json:"fanMode"`
+	Enabled      bool    `json:"enabled"`
+}
+
+// APIZoneSchedule holds up to five periods per day.  Days left out of an
+// update are not written.
+type APIZoneSchedule struct {
+	Sunday    []APISchedulePeriod `json:"sunday,omitempty"`
+	Monday    []APISchedulePeriod `json:"monday,omitempty"`
+	Tuesday   []APISchedulePeriod `json:"tuesday,omitempty"`
+	Wednesday []APISchedulePeriod `json:"wednesday,omitempty"`
+	Thursday  []APISchedulePeriod `json:"thursday,omitempty"`
+	Friday    []APISchedulePeriod `json:"friday,omitempty"`
+	Saturday  []APISchedulePeriod `json:"saturday,omitempty"`
+}
+
+// APISchedule is the import/export document covering every configured zone.
+type APISchedule struct {
+	Zones map[string]APIZoneSchedule `json:"zones"`
+}
+
+func (api *APIZoneSchedule) days() [scheduleDays]*[]APISchedulePeriod {
+	return [scheduleDays]*[]APISchedulePeriod{
+		&api.Sunday, &api.Monday, &api.Tuesday, &api.Wednesday,
+		&api.Thursday, &api.Friday, &api.Saturday,
+	}
+}
+
+func formatScheduleTime(minutes uint16) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// parseScheduleTime parses an "HH:MM" start time.  The thermostat schedules
+// in 15 minute steps.
+func parseScheduleTime(s string) (uint16, bool) {
+	if len(s) != 5 || s[2] != ':' {
+		return 0, false
+	}
+	h, err := strconv.Atoi(s[0:2])
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	m, err := strconv.Atoi(s[3:5])
+	if err != nil || m < 0 || m > 59 || m%15 != 0 {
+		return 0, false
+	}
+	return uint16(h*60 + m), true
+}
+
+func (sched TStatZoneSchedule) toAPI() APIZoneSchedule {
+	api := APIZoneSchedule{}
+
+	for d, day := range api.days() {
+		periods := []APISchedulePeriod{}
+		for _, p := range sched.Days[d] {
+			periods = append(periods, APISchedulePeriod{
+				Start:        formatScheduleTime(p.StartTime),
+				HeatSetpoint: float64(p.HeatSetpoint),
+				CoolSetpoint: float64(p.CoolSetpoint),
+				FanMode:      rawFanModeToString(p.FanMode),
+				Enabled:      p.Enabled == 1,
+			})
+		}
+		*day = periods
+	}
+
+	return api
+}
+
+// fromAPI copies the days present in api into sched, validating every
+// enabled period, and returns the write flags covering them.  Days with fewer than
+// five periods are padded with disabled periods.
+func (sched *TStatZoneSchedule) fromAPI(api *APIZoneSchedule) (byte, error) {
+	flags := byte(0)
+
+	for d, day := range api.days() {
+		if *day == nil {
+			continue
+		}
+		name := scheduleDayNames[d]
+
+		if len(*day) > schedulePeriods {
+			return 0, fmt.Errorf("%s: at most %d periods are allowed", name, schedulePeriods)
+		}
+
+		var periods [schedulePeriods]TStatSchedulePeriod
+		last := -1
+		for i, p := range *day {
+			if !p.Enabled {
+				// disabled periods are never run, so they aren't
+				// validated; a start time or fan mode that doesn't
+				// parse is written as zero
+				start, _ := parseScheduleTime(p.Start)
+				fan, _ := stringFanModeToRaw(p.FanMode)
+				periods[i] = TStatSchedulePeriod{
+					StartTime:    start,
+					HeatSetpoint: rawTemp(p.HeatSetpoint),
+					CoolSetpoint: rawTemp(p.CoolSetpoint),
+					FanMode:      fan,
+				}
+				continue
+			}
+
+			start, ok := parseScheduleTime(p.Start)
+			if !ok {
+				return 0, fmt.Errorf("%s period %d: start must be HH:MM in 15 minute steps", name, i+1)
+			}
+			if int(start) <= last {
+				return 0, fmt.Errorf("%s period %d: start times must be increasing", name, i+1)
+			}
+			last = int(start)
+
+			fan, ok := stringFanModeToRaw(p.FanMode)
+			if !ok {
+				return 0, fmt.Errorf("%s period %d: invalid fan mode: %s", name, i+1, p.FanMode)
+			}
+
+			if !validSetpoint(p.HeatSetpoint, minHeatSetpoint, maxHeatSetpoint) {
+				return 0, fmt.Errorf("%s period %d: heatSetpoint must be between %d and %d degrees F",
+					name, i+1, minHeatSetpoint, maxHeatSetpoint)
+			}
+			if !validSetpoint(p.CoolSetpoint, minCoolSetpoint, maxCoolSetpoint) {
+				return 0, fmt.Errorf("%s period %d: coolSetpoint must be between %d and %d degrees F",
+					name, i+1, minCoolSetpoint, maxCoolSetpoint)
+			}
+			heat := rawTemp(p.HeatSetpoint)
+			cool := rawTemp(p.CoolSetpoint)
+			if heat >= cool {
+				return 0, fmt.Errorf("%s period %d: heatSetpoint must be below coolSetpoint", name, i+1)
+			}
+
+			periods[i] = TStatSchedulePeriod{
+				StartTime:    start,
+				HeatSetpoint: heat,
+				CoolSetpoint: cool,
+				FanMode:      fan,
+				Enabled:      1,
+			}
+		}
+
+		sched.Days[d] = periods
+		flags |= 0x01 << d
+	}
+
+	return flags, nil
+}
+
+func (api APIZoneSchedule) inUnits(u tempUnits) interface{} {
+	out := APIZoneSchedule{}
+	src := api.days()
+	for d, day := range out.days() {
+		if *src[d] == nil {
+			continue
+		}
+		periods := make([]APISchedulePeriod, len(*src[d]))
+		for i, p := range *src[d] {
+			p.HeatSetpoint = u.fromF(p.HeatSetpoint)
+			p.CoolSetpoint = u.fromF(p.CoolSetpoint)
+			periods[i] = p
+		}
+		*day = periods
+	}
+	return out
+}
+
+func (api *APIZoneSchedule) fromUnits(u tempUnits) {
+	for _, day := range api.days() {
+		for i := range *day {
+			(*day)[i].HeatSetpoint = u.toF((*day)[i].HeatSetpoint)
+			(*day)[i].CoolSetpoint = u.toF((*day)[i].CoolSetpoint)
+		}
+	}
+}
+
+func (api APISchedule) inUnits(u tempUnits) interface{} {
+	out := APISchedule{Zones: make(map[string]APIZoneSchedule)}
+	for zone, sched := range api.Zones {
+		out.Zones[zone] = sched.inUnits(u).(APIZoneSchedule)
+	}
+	return out
+}
+
+func (api *APISchedule) fromUnits(u tempUnits) {
+	for zone, sched := range api.Zones {
+		sched.fromUnits(u)
+		api.Zones[zone] = sched
+	}
+}
+
+func getZoneSchedule(zone int, priority actionPriority) (*APIZoneSchedule, bool) {
+	sched := TStatZoneSchedule{}
+	ok := infinity.ReadPriority(devTSTAT, scheduleTableAddr(zone), &sched, priority)
+	if !ok {
+		return nil, false
+	}
+
+	api := sched.toAPI()
+	return &api, true
+}
+
+// putZoneSchedule writes the days present in api.  The table is read first
+// so that days left out are written back unchanged.
+func putZoneSchedule(zone int, api *APIZoneSchedule) (bool, error) {
+	if _, err := new(TStatZoneSchedule).fromAPI(api); err != nil {
+		return false, err
+	}
+
+	sched := TStatZoneSchedule{}
+	addr := scheduleTableAddr(zone)
+	if !infinity.Read(devTSTAT, addr, &sched) {
+		return false, nil
+	}
+
+	flags, _ := sched.fromAPI(api)
+	if flags == 0 {
+		return true, nil
+	}
+
+	ok, err := writeTableAt(devTSTAT, addr, flags, sched)
+	pollNow("schedule")
+	return ok, err
+}
+
+// configuredZones returns zone 1 plus any zone that has been named at the
+// thermostat.
+func configuredZones(priority actionPriority) ([]int, bool) {
+	cfg := TStatZoneParams{}
+	ok := infinity.ReadTablePriority(devTSTAT, &cfg, priority)
+	if !ok {
+		return nil, false
+	}
+	return cfg.zones(), true
+}
+
+// getSchedule exports the schedules of every configured zone.
+func getSchedule(priority actionPriority) (*APISchedule, bool) {
+	zones, ok := configuredZones(priority)
+	if !ok {
+		return nil, false
+	}
+
+	api := APISchedule{Zones: make(map[string]APIZoneSchedule)}
+	for _, zone := range zones {
+		sched, ok := getZoneSchedule(zone, priority)
+		if !ok {
+			return nil, false
+		}
+		api.Zones[strconv.Itoa(zone)] = *sched
+	}
+	return &api, true
+}
+
+// putSchedule imports a schedule document.  Every zone is validated before
+// anything is written.
+func putSchedule(api *APISchedule) (bool, error) {
+	zones := make(map[int]APIZoneSchedule)
+	for name, sched := range api.Zones {
+		zone, err := strconv.Atoi(name)
+		if err != nil || zone < 1 || zone > maxZones {
+			return false, fmt.Errorf("zone must be between 1 and %d", maxZones)
+		}
+		if _, err := new(TStatZoneSchedule).fromAPI(&sched); err != nil {
+			return false, fmt.Errorf("zone %d: %s", zone, err)
+		}
+		zones[zone] = sched
+	}
+
+	for zone, sched := range zones {
+		ok, err := putZoneSchedule(zone, &sched)
+		if !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestScheduleFromAPI(t *testing.T) {
+	period := func(start string, heat, cool float64, enabled bool) APISchedulePeriod {
+		return APISchedulePeriod{Start: start, HeatSetpoint: heat, CoolSetpoint: cool, FanMode: "auto", Enabled: enabled}
+	}
+
+	tests := []struct {
+		name    string
+		periods []APISchedulePeriod
+		ok      bool
+	}{
+		{"valid", []APISchedulePeriod{period("06:00", 68, 76, true), period("22:00", 62, 80, true)}, true},
+		{"bad start", []APISchedulePeriod{period("06:10", 68, 76, true)}, false},
+		{"decreasing", []APISchedulePeriod{period("22:00", 68, 76, true), period("06:00", 62, 80, true)}, false},
+		{"heat too low", []APISchedulePeriod{period("06:00", 30, 76, true)}, false},
+		{"cool wraps", []APISchedulePeriod{period("06:00", 68, 332, true)}, false},
+		{"heat above cool", []APISchedulePeriod{period("06:00", 80, 76, true)}, false},
+		{"disabled padding", []APISchedulePeriod{period("06:00", 68, 76, true), period("00:00", 0, 0, false)}, true},
+		{"too many", make([]APISchedulePeriod, schedulePeriods+1), false},
+	}
+
+	for _, tt := range tests {
+		api := APIZoneSchedule{Monday: tt.periods}
+		_, err := new(TStatZoneSchedule).fromAPI(&api)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// TestScheduleRoundTrip checks that an exported schedule, including the
+// disabled periods the thermostat pads days with, can be imported again.
+func TestScheduleRoundTrip(t *testing.T) {
+	var sched TStatZoneSchedule
+	sched.Days[1][0] = TStatSchedulePeriod{StartTime: 6 * 60, HeatSetpoint: 68, CoolSetpoint: 76, Enabled: 1}
+	sched.Days[1][1] = TStatSchedulePeriod{StartTime: 22 * 60, HeatSetpoint: 62, CoolSetpoint: 80, FanMode: 1, Enabled: 1}
+
+	for _, u := range []tempUnits{unitsF, unitsC} {
+		api := sched.toAPI().inUnits(u).(APIZoneSchedule)
+		api.fromUnits(u)
+
+		var got TStatZoneSchedule
+		flags, err := got.fromAPI(&api)
+		if err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+		if flags != 0x7f {
+			t.Errorf("%s: flags %02x, want 7f", u, flags)
+		}
+		if got != sched {
+			t.Errorf("%s: got %v, want %v", u, got.Days[1], sched.Days[1])
+		}
+	}
+}
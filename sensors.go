@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reading snooped from an Infinity remote room sensor.  Temp is nil on a
+// sensor fault and Humidity is nil for sensors without a humidity sensor.
+type RemoteSensor struct {
+	Address  string   `json:"address"`
+	Zone     uint8    `json:"zone"` // 0 if not assigned to a zone
+	Temp     *float32 `json:"temp"`
+	Humidity *uint8   `json:"humidity"`
+}
+
+type RemoteSensors []RemoteSensor
+
+func (sensors RemoteSensors) inUnits(u tempUnits) interface{} {
+	out := make(RemoteSensors, len(sensors))
+	for i, s := range sensors {
+		s.Temp = u.optSensorFromF(s.Temp)
+		out[i] = s
+	}
+	return out
+}
+
+// APIRemoteSensor adds what the thermostat reports for the sensor's zone so
+// the two can be compared.
+type APIRemoteSensor struct {
+	RemoteSensor
+	ZoneTemp     *float64 `json:"zoneTemp"`
+	ZoneHumidity *uint8   `json:"zoneHumidity"`
+}
+
+type APIRemoteSensors []APIRemoteSensor
+
+func (s APIRemoteSensor) inUnits(u tempUnits) interface{} {
+	s.Temp = u.optSensorFromF(s.Temp)
+	s.ZoneTemp = u.optFromF(s.ZoneTemp)
+	return s
+}
+
+func (sensors APIRemoteSensors) inUnits(u tempUnits) interface{} {
+	out := make(APIRemoteSensors, len(sensors))
+	for i, s := range sensors {
+		out[i] = s.inUnits(u).(APIRemoteSensor)
+	}
+	return out
+}
+
+func getRemoteSensors() RemoteSensors {
+	sensors, _ := getSection(state, &state.sensors)
+	return append(RemoteSensors{}, sensors...)
+}
+
+// updateRemoteSensor stores a sensor reading, keeping the list in address
+// order.
+func updateRemoteSensor(sensor RemoteSensor) {
+	sensors := getRemoteSensors()
+
+	found := false
+	for i := range sensors {
+		if sensors[i].Address == sensor.Address {
+			sensors[i] = sensor
+			found = true
+		}
+	}
+	if !found {
+		sensors = append(sensors, sensor)
+		sort.Slice(sensors, func(i, j int) bool { return sensors[i].Address < sensors[j].Address })
+	}
+
+	setSection(state, &state.sensors, sensors, sourceSnooped)
+}
+
+// getRemoteSensorReadings returns the sensor readings along with the
+// thermostat's temperature and humidity for each sensor's zone, as read
+// within maxAge.
+func getRemoteSensorReadings(maxAge time.Duration) (APIRemoteSensors, bool) {
+	t, ok := cachedZoneTables(maxAge)
+	if !ok {
+		return nil, false
+	}
+	params := &t.params
+
+	readings := APIRemoteSensors{}
+	for _, s := range getRemoteSensors() {
+		r := APIRemoteSensor{RemoteSensor: s}
+		if s.Zone >= 1 && s.Zone <= maxZones {
+			r.ZoneTemp = sensorTemp(params.CurrentTemp[s.Zone-1])
+			humidity := params.CurrentHumidity[s.Zone-1]
+			r.ZoneHumidity = &humidity
+		}
+		readings = append(readings, r)
+	}
+	return readings, true
+}
+
+func getRemoteSensorReading(addr uint16, maxAge time.Duration) (*APIRemoteSensor, bool) {
+	readings, ok := getRemoteSensorReadings(maxAge)
+	if !ok {
+		return nil, false
+	}
+
+	address := fmt.Sprintf("%04x", addr)
+	for _, r := range readings {
+		if r.Address == address {
+			return &r, true
+		}
+	}
+	return nil, true
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stateSource records how a section value was last refreshed.
+type stateSource string
+
+const (
+	sourcePolled  stateSource = "polled"
+	sourceSnooped stateSource = "snooped"
+)
+
+// sectionMeta is the bookkeeping common to every section.  version is
+// bumped every time the value changes, updated every time it is refreshed
+// even if unchanged.  name is the source used for its events.
+type sectionMeta struct {
+	name    string
+	present bool
+	version uint64
+	updated time.Time
+	source  stateSource
+	polled  time.Time
+	snooped time.Time
+	maxAge  time.Duration
+	stale   bool
+}
+
+// stateSection holds one part of the system state.
+type stateSection[T any] struct {
+	sectionMeta
+	value T
+}
+
+// SystemState is the last known state of the thermostat, zones, equipment
+// and devices, gathered by polling and snooping.  Values are stored and
+// returned by value; slices and maps handed to it must not be modified
+// afterwards.
+type SystemState struct {
+	mutex sync.RWMutex
+
+	tstat      stateSection[TStatZoneConfig] // zone 1, kept for existing clients
+	zones      stateSection[ZoneConfigs]
+	settings   stateSection[APITStatSettings]
+	schedule   stateSection[APISchedule]
+	airHandler stateSection[AirHandler]
+	heatPump   stateSection[HeatPump]
+	dampers    stateSection[Dampers]
+	sensors    stateSection[RemoteSensors]
+	devices    stateSection[[]StateDevice]
+	sam        stateSection[SAMTables]
+
+	// the raw tables behind tstat and zones, kept so any zone can be
+	// answered from them
+	tables *zoneTables
+}
+
+type StateDevice struct {
+	Address string         `json:"address"`
+	Class   string         `json:"class"`
+	Info    *APIDeviceInfo `json:"info"`
+}
+
+// StateSnapshot is a consistent copy of the whole state.  Sections that
+// haven't been seen yet are nil.
+type StateSnapshot struct {
+	Thermostat *TStatZoneConfig          `json:"tstat"`
+	Zones      ZoneConfigs               `json:"zones"`
+	Settings   *APITStatSettings         `json:"settings"`
+	Schedule   *APISchedule              `json:"schedule"`
+	AirHandler *AirHandler               `json:"blower"`
+	HeatPump   *HeatPump                 `json:"heatpump"`
+	Dampers    *Dampers                  `json:"dampers"`
+	Sensors    RemoteSensors             `json:"sensors"`
+	Devices    []StateDevice             `json:"devices"`
+	SAM        SAMTables                 `json:"sam"`
+	Sections   map[string]APISectionMeta `json:"sections"`
+}
+
+// APISectionMeta describes how fresh a section is.  Times are omitted until
+// the section has been refreshed that way.
+type APISectionMeta struct {
+	Version     uint64      `json:"version"`
+	LastUpdated *time.Time  `json:"lastUpdated,omitempty"`
+	Source      stateSource `json:"source,omitempty"`
+	LastPolled  *time.Time  `json:"lastPolled,omitempty"`
+	LastSnooped *time.Time  `json:"lastSnooped,omitempty"`
+	MaxAge      string      `json:"maxAge"`
+	Stale       bool        `json:"stale"`
+}
+
+// APIStaleEvent is sent with source "stale" when a section stops being
+// refreshed within its max age, and again when data arrives for it.
+type APIStaleEvent struct {
+	Section     string     `json:"section"`
+	Stale       bool       `json:"stale"`
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
+}
+
+// Default max ages of the snooped sections, chosen to allow a few missed
+// refreshes of the thermostat's own polling.  Polled sections default to
+// three poll intervals.  Both can be set with -max-age.
+var sectionMaxAge = map[string]time.Duration{
+	"blower":   time.Minute,
+	"heatpump": 2 * time.Minute,
+	"dampers":  2 * time.Minute,
+	"sensors":  5 * time.Minute,
+}
+
+// unpolledMaxAge is the default max age of polled sections whose poll has
+// been disabled, so requests still read the thermostat now and then.
+const unpolledMaxAge = time.Minute
+
+// staleCheckInterval is how often sections are checked for staleness.
+var staleCheckInterval = 5 * time.Second
+
+var state = newSystemState()
+
+func newSystemState() *SystemState {
+	s := &SystemState{}
+	s.tstat.name = "tstat"
+	s.zones.name = "zones"
+	s.settings.name = "settings"
+	s.schedule.name = "schedule"
+	s.airHandler.name = "blower"
+	s.heatPump.name = "heatpump"
+	s.dampers.name = "dampers"
+	s.sensors.name = "sensors"
+	s.devices.name = "devices"
+	s.sam.name = "sam"
+	return s
+}
+
+// sections returns the bookkeeping of every section, in a fixed order.
+func (s *SystemState) sections() []*sectionMeta {
+	return []*sectionMeta{
+		&s.tstat.sectionMeta,
+		&s.zones.sectionMeta,
+		&s.settings.sectionMeta,
+		&s.schedule.sectionMeta,
+		&s.airHandler.sectionMeta,
+		&s.heatPump.sectionMeta,
+		&s.dampers.sectionMeta,
+		&s.sensors.sectionMeta,
+		&s.devices.sectionMeta,
+		&s.sam.sectionMeta,
+	}
+}
+
+// setMaxAges applies sectionMaxAge and the poll intervals.  Must be called
+// before the state is shared.
+func (s *SystemState) setMaxAges() {
+	for _, m := range s.sections() {
+		if maxAge, ok := sectionMaxAge[m.name]; ok {
+			m.maxAge = maxAge
+		} else if interval, ok := sectionPollInterval(m.name); ok && interval > 0 {
+			m.maxAge = 3 * interval
+		} else if ok {
+			m.maxAge = unpolledMaxAge
+		}
+	}
+}
+
+func (s *SystemState) sectionMaxAge(name string) time.Duration {
+	for _, m := range s.sections() {
+		if m.name == name {
+			return m.maxAge
+		}
+	}
+	return 0
+}
+
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (m *sectionMeta) toAPI() APISectionMeta {
+	api := APISectionMeta{
+		Version:     m.version,
+		LastUpdated: optTime(m.updated),
+		Source:      m.source,
+		LastPolled:  optTime(m.polled),
+		LastSnooped: optTime(m.snooped),
+		Stale:       m.stale || (m.present && m.updated.IsZero()),
+	}
+	if m.maxAge > 0 {
+		api.MaxAge = m.maxAge.String()
+	}
+	return api
+}
+
+func getSection[T any](s *SystemState, sec *stateSection[T]) (T, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return sec.value, sec.present
+}
+
+func getSectionMeta[T any](s *SystemState, sec *stateSection[T]) APISectionMeta {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return sec.toAPI()
+}
+
+// seedSection stores a starting value that hasn't come from the bus.  The
+// section is reported stale until it is first refreshed.
+func seedSection[T any](s *SystemState, sec *stateSection[T], value T) {
+	s.mutex.Lock()
+	sec.value = value
+	sec.present = true
+	s.mutex.Unlock()
+}
+
+// setSection stores a refreshed section value.  If it changed the version
+// is bumped and the new value is broadcast to event listeners.
+func setSection[T any](s *SystemState, sec *stateSection[T], value T, source stateSource) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	sec.updated = now
+	sec.source = source
+	if source == sourcePolled {
+		sec.polled = now
+	} else {
+		sec.snooped = now
+	}
+	wasStale := sec.stale
+	sec.stale = false
+	changed := !sec.present || !reflect.DeepEqual(sec.value, value)
+	if changed {
+		sec.value = value
+		sec.present = true
+		sec.version++
+	}
+	s.mutex.Unlock()
+
+	if wasStale {
+		log.Infof("%s data is being refreshed again", sec.name)
+		Dispatcher.broadcastEvent("stale", &APIStaleEvent{Section: sec.name, Stale: false, LastUpdated: &now})
+	}
+	if changed {
+		Dispatcher.broadcastEvent(sec.name, value)
+	}
+}
+
+// cachedSection returns a section value if it was refreshed within maxAge,
+// otherwise calls refresh to read it from the bus first.
+func cachedSection[T any](s *SystemState, sec *stateSection[T], maxAge time.Duration, refresh func() bool) (T, bool) {
+	s.mutex.RLock()
+	value, fresh := sec.value, sec.fresh(maxAge)
+	s.mutex.RUnlock()
+
+	if fresh {
+		return value, true
+	}
+	if !refresh() {
+		var zero T
+		return zero, false
+	}
+	return getSection(s, sec)
+}
+
+// fresh reports whether the section was refreshed within maxAge.  Must be
+// called with the mutex held.
+func (m *sectionMeta) fresh(maxAge time.Duration) bool {
+	return m.present && !m.updated.IsZero() && time.Since(m.updated) <= maxAge
+}
+
+// checkStale flags sections that haven't been refreshed within their max
+// age and returns events for the ones that just went stale.
+func (s *SystemState) checkStale(now time.Time) []*APIStaleEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := []*APIStaleEvent{}
+	for _, m := range s.sections() {
+		if m.stale || m.updated.IsZero() || m.maxAge <= 0 {
+			continue
+		}
+		if now.Sub(m.updated) > m.maxAge {
+			m.stale = true
+			events = append(events, &APIStaleEvent{Section: m.name, Stale: true, LastUpdated: optTime(m.updated)})
+		}
+	}
+	return events
+}
+
+// staleWatcher reports sections whose data has stopped arriving.
+func staleWatcher() {
+	for {
+		time.Sleep(staleCheckInterval)
+
+		for _, event := range state.checkStale(time.Now()) {
+			log.Warnf("%s data is stale, last updated %s", event.Section, event.LastUpdated.Format(time.RFC3339))
+			Dispatcher.broadcastEvent("stale", event)
+		}
+	}
+}
+
+// optSection returns a pointer to a copy of the section value, or nil if it
+// isn't present.  Must be called with the mutex held.
+func optSection[T any](sec *stateSection[T]) *T {
+	if !sec.present {
+		return nil
+	}
+	v := sec.value
+	return &v
+}
+
+func (s *SystemState) snapshot() StateSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snap := StateSnapshot{
+		Thermostat: optSection(&s.tstat),
+		Settings:   optSection(&s.settings),
+		Schedule:   optSection(&s.schedule),
+		AirHandler: optSection(&s.airHandler),
+		HeatPump:   optSection(&s.heatPump),
+		Dampers:    optSection(&s.dampers),
+		Sections:   make(map[string]APISectionMeta),
+	}
+	for _, m := range s.sections() {
+		snap.Sections[m.name] = m.toAPI()
+	}
+
+	// copy so the snapshot can't be changed by later updates
+	if s.zones.present {
+		snap.Zones = make(ZoneConfigs, len(s.zones.value))
+		for k, v := range s.zones.value {
+			snap.Zones[k] = v
+		}
+	}
+	if s.sensors.present {
+		snap.Sensors = append(RemoteSensors{}, s.sensors.value...)
+	}
+	if s.devices.present {
+		snap.Devices = append([]StateDevice{}, s.devices.value...)
+	}
+	if s.sam.present {
+		snap.SAM = make(SAMTables, len(s.sam.value))
+		for k, v := range s.sam.value {
+			snap.SAM[k] = v
+		}
+	}
+	return snap
+}
+
+// events returns an event for every section that is present, in the same
+// form they are broadcast when they change.
+func (snap StateSnapshot) events() []broadcastEvent {
+	events := []broadcastEvent{}
+	add := func(source string, present bool, data interface{}) {
+		if present {
+			events = append(events, broadcastEvent{Source: source, Data: data})
+		}
+	}
+
+	add("tstat", snap.Thermostat != nil, snap.Thermostat)
+	add("zones", snap.Zones != nil, snap.Zones)
+	add("settings", snap.Settings != nil, snap.Settings)
+	add("schedule", snap.Schedule != nil, snap.Schedule)
+	add("blower", snap.AirHandler != nil, snap.AirHandler)
+	add("heatpump", snap.HeatPump != nil, snap.HeatPump)
+	add("dampers", snap.Dampers != nil, snap.Dampers)
+	add("sensors", snap.Sensors != nil, snap.Sensors)
+	add("devices", snap.Devices != nil, snap.Devices)
+	add("sam", snap.SAM != nil, snap.SAM)
+	return events
+}
+
+func (snap StateSnapshot) inUnits(u tempUnits) interface{} {
+	if snap.Thermostat != nil {
+		t := snap.Thermostat.inUnits(u).(TStatZoneConfig)
+		snap.Thermostat = &t
+	}
+	if snap.Zones != nil {
+		snap.Zones = snap.Zones.inUnits(u).(ZoneConfigs)
+	}
+	if snap.Settings != nil {
+		t := snap.Settings.inUnits(u).(APITStatSettings)
+		snap.Settings = &t
+	}
+	if snap.Schedule != nil {
+		t := snap.Schedule.inUnits(u).(APISchedule)
+		snap.Schedule = &t
+	}
+	if snap.HeatPump != nil {
+		t := snap.HeatPump.inUnits(u).(HeatPump)
+		snap.HeatPump = &t
+	}
+	if snap.Sensors != nil {
+		snap.Sensors = snap.Sensors.inUnits(u).(RemoteSensors)
+	}
+	if snap.SAM != nil {
+		snap.SAM = snap.SAM.inUnits(u).(SAMTables)
+	}
+	return snap
+}
+
+// durationsFlag parses a comma separated list of name=duration into
+// values, accepting only the names returned by valid.
+type durationsFlag struct {
+	values map[string]time.Duration
+	valid  func() []string
+}
+
+func (f durationsFlag) String() string {
+	return ""
+}
+
+func (f durationsFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		name, d, found := strings.Cut(item, "=")
+		if !found {
+			return errors.New("expected name=duration")
+		}
+		known := false
+		for _, v := range f.valid() {
+			known = known || v == name
+		}
+		if !known {
+			return fmt.Errorf("unknown name %q, expected one of %s", name, strings.Join(f.valid(), ", "))
+		}
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return err
+		}
+		f.values[name] = duration
+	}
+	return nil
+}
+
+func sectionNames() []string {
+	names := []string{}
+	for _, m := range state.sections() {
+		names = append(names, m.name)
+	}
+	return names
+}
@@ -1,97 +1,84 @@
 package main
 
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
 type InfinityTableAddr [3]byte
 type InfinityTable interface {
 	addr() InfinityTableAddr
 }
 
+// Temperatures are signed, see sensorFaultTemp.
 type TStatCurrentParams struct {
-	Z1CurrentTemp     uint8
-	Z2CurrentTemp     uint8
-	Z3CurrentTemp     uint8
-	Z4CurrentTemp     uint8
-	Z5CurrentTemp     uint8
-	Z6CurrentTemp     uint8
-	Z7CurrentTemp     uint8
-	Z8CurrentTemp     uint8
-	Z1CurrentHumidity uint8
-	Z2CurrentHumidity uint8
-	Z3CurrentHumidity uint8
-	Z4CurrentHumidity uint8
-	Z5CurrentHumidity uint8
-	Z6CurrentHumidity uint8
-	Z7CurrentHumidity uint8
-	Z8CurrentHumidity uint8
-	Unknown1          uint8
-	OutdoorAirTemp    uint8
-	ZoneUnocc         uint8 // bitflags
-	Mode              uint8
-	Unknown2          [5]uint8
-	DisplayedZone     uint8
+	CurrentTemp     [8]int8
+	CurrentHumidity [8]uint8
+	Unknown1        uint8
+	OutdoorAirTemp  int8
+	ZoneUnocc       uint8 // bitflags
+	Mode            uint8
+	Unknown2        [5]uint8
+	DisplayedZone   uint8
 }
 
 func (params TStatCurrentParams) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x3B, 0x02}
 }
 
+// Only the mode is writable, with flag 0x10.  The high bits of the mode
+// byte carry the current stage, so only the low nibble is compared.
+func (params TStatCurrentParams) mismatches(actual interface{}, flags uint8) []string {
+	a := actual.(*TStatCurrentParams)
+	if flags&0x10 != 0 && a.Mode&0x0f != params.Mode&0x0f {
+		return []string{"Mode"}
+	}
+	return nil
+}
+
+// Per-zone values are indexed by zone number minus one.  Write flags follow
+// field order: 0x01 fan mode, 0x02 hold, 0x04 heat setpoint, 0x08 cool
+// setpoint, 0x10 target humidity.
 type TStatZoneParams struct {
-	Z1FanMode        uint8
-	Z2FanMode        uint8
-	Z3FanMode        uint8
-	Z4FanMode        uint8
-	Z5FanMode        uint8
-	Z6FanMode        uint8
-	Z7FanMode        uint8
-	Z8FanMode        uint8
-	ZoneHold         uint8 // bitflags
-	Z1HeatSetpoint   uint8
-	Z2HeatSetpoint   uint8
-	Z3HeatSetpoint   uint8
-	Z4HeatSetpoint   uint8
-	Z5HeatSetpoint   uint8
-	Z6HeatSetpoint   uint8
-	Z7HeatSetpoint   uint8
-	Z8HeatSetpoint   uint8
-	Z1CoolSetpoint   uint8
-	Z2CoolSetpoint   uint8
-	Z3CoolSetpoint   uint8
-	Z4CoolSetpoint   uint8
-	Z5CoolSetpoint   uint8
-	Z6CoolSetpoint   uint8
-	Z7CoolSetpoint   uint8
-	Z8CoolSetpoint   uint8
-	Z1TargetHumidity uint8
-	Z2TargetHumidity uint8
-	Z3TargetHumidity uint8
-	Z4TargetHumidity uint8
-	Z5TargetHumidity uint8
-	Z6TargetHumidity uint8
-	Z7TargetHumidity uint8
-	Z8TargetHumidity uint8
-	FanAutoCfg       uint8
-	Unknown          uint8
-	Z1HoldDuration   uint16
-	Z2HoldDuration   uint16
-	Z3HoldDuration   uint16
-	Z4HoldDuration   uint16
-	Z5HoldDuration   uint16
-	Z6HoldDuration   uint16
-	Z7HoldDuration   uint16
-	Z8HoldDuration   uint16
-	Z1Name           [12]byte
-	Z2Name           [12]byte
-	Z3Name           [12]byte
-	Z4Name           [12]byte
-	Z5Name           [12]byte
-	Z6Name           [12]byte
-	Z7Name           [12]byte
-	Z8Name           [12]byte
+	FanMode        [8]uint8
+	ZoneHold       uint8 // bitflags
+	HeatSetpoint   [8]uint8
+	CoolSetpoint   [8]uint8
+	TargetHumidity [8]uint8 // humidify setpoint
+	FanAutoCfg     uint8
+	Unknown        uint8
+	HoldDuration   [8]uint16
+	Name           [8][12]byte
 }
 
 func (params TStatZoneParams) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x3B, 0x03}
 }
 
+// zones returns zone 1 plus any zone that has been named at the thermostat.
+func (params TStatZoneParams) zones() []int {
+	zones := []int{1}
+	for z := 1; z < len(params.Name); z++ {
+		if len(rawString(params.Name[z][:])) > 0 {
+			zones = append(zones, z+1)
+		}
+	}
+	return zones
+}
+
+// Dehumidify setpoints and humidity equipment activity.  Only the setpoints
+// are writable (flag 0x01).
+type TStatHumidityParams struct {
+	DehumidifySetpoint [8]uint8
+	Active             uint8 // bitflags: 0x01 humidifying, 0x02 dehumidifying
+	Unknown            [3]uint8
+}
+
+func (params TStatHumidityParams) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3B, 0x05}
+}
+
 type TStatVacationParams struct {
 	Active         uint8
 	Hours          uint16
@@ -106,26 +93,51 @@ func (params TStatVacationParams) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x3B, 0x04}
 }
 
+// Humidity limits for vacation mode, in percent RH.
+const (
+	minVacationHumidity = 5
+	maxVacationHumidity = 95
+)
+
+// maxVacationHours is the longest vacation whose remaining days still fit
+// in the one byte reported by the API.
+const maxVacationHours = 255 * 24
+
+// Start and End describe a planned vacation, see vacation.go.
 type APIVacationConfig struct {
-	Active         *bool   `json:"active"`
-	Days           *uint8  `json:"days"`
-	MinTemperature *uint8  `json:"minTemperature"`
-	MaxTemperature *uint8  `json:"maxTemperature"`
-	MinHumidity    *uint8  `json:"minHumidity"`
-	MaxHumidity    *uint8  `json:"maxHumidity"`
-	FanMode        *string `json:"fanMode"`
+	Active         *bool    `json:"active"`
+	Days           *uint8   `json:"days"`
+	Hours          *uint16  `json:"hours"`
+	MinTemperature *float64 `json:"minTemperature"`
+	MaxTemperature *float64 `json:"maxTemperature"`
+	MinHumidity    *uint8   `json:"minHumidity"`
+	MaxHumidity    *uint8   `json:"maxHumidity"`
+	FanMode        *string  `json:"fanMode"`
+	Start          *string  `json:"start,omitempty"`
+	End            *string  `json:"end,omitempty"`
 }
 
 func (params TStatVacationParams) toAPI() APIVacationConfig {
-	api := APIVacationConfig{MinTemperature: &params.MinTemperature,
-		MaxTemperature: &params.MaxTemperature,
-		MinHumidity:    &params.MinHumidity,
-		MaxHumidity:    &params.MaxHumidity}
+	api := APIVacationConfig{MinHumidity: &params.MinHumidity,
+		MaxHumidity: &params.MaxHumidity,
+		Hours:       &params.Hours}
+
+	minTemp := float64(params.MinTemperature)
+	api.MinTemperature = &minTemp
+
+	maxTemp := float64(params.MaxTemperature)
+	api.MaxTemperature = &maxTemp
 
 	active := bool(params.Active == 1)
 	api.Active = &active
 
-	days := uint8(params.Hours / 7)
+	// round up so an active vacation never reports zero days left, and
+	// clamp what the thermostat reports to what days can hold
+	hours := params.Hours
+	if hours > maxVacationHours {
+		hours = maxVacationHours
+	}
+	days := uint8((hours + 23) / 24)
 	api.Days = &days
 
 	mode := rawFanModeToString(params.FanMode)
@@ -134,42 +146,122 @@ func (params TStatVacationParams) toAPI() APIVacationConfig {
 	return api
 }
 
-func (params *TStatVacationParams) fromAPI(config *APIVacationConfig) byte {
+func (api APIVacationConfig) inUnits(u tempUnits) interface{} {
+	if api.MinTemperature != nil {
+		t := u.fromF(*api.MinTemperature)
+		api.MinTemperature = &t
+	}
+	if api.MaxTemperature != nil {
+		t := u.fromF(*api.MaxTemperature)
+		api.MaxTemperature = &t
+	}
+	return api
+}
+
+func (api *APIVacationConfig) fromUnits(u tempUnits) {
+	if api.MinTemperature != nil {
+		t := u.toF(*api.MinTemperature)
+		api.MinTemperature = &t
+	}
+	if api.MaxTemperature != nil {
+		t := u.toF(*api.MaxTemperature)
+		api.MaxTemperature = &t
+	}
+}
+
+// fromAPI copies the fields present in config into params and returns the
+// write flags covering them.  Vacation is enabled by a non-zero duration and
+// disabled by a zero one, or by setting active to false.  The planned start
+// and end are handled by the caller.
+func (params *TStatVacationParams) fromAPI(config *APIVacationConfig) (byte, error) {
 	flags := byte(0)
 
+	if config.Days != nil && config.Hours != nil {
+		return 0, fmt.Errorf("only one of days and hours may be given")
+	}
+
 	if config.Days != nil {
 		params.Hours = uint16(*config.Days) * uint16(24)
 		flags |= 0x02
 	}
 
+	if config.Hours != nil {
+		if *config.Hours > maxVacationHours {
+			return 0, fmt.Errorf("hours must be at most %d", maxVacationHours)
+		}
+		params.Hours = *config.Hours
+		flags |= 0x02
+	}
+
+	if config.Active != nil {
+		if *config.Active && (flags&0x02 == 0 || params.Hours == 0) {
+			return 0, fmt.Errorf("non-zero days or hours are required to activate vacation")
+		}
+		if !*config.Active {
+			if flags&0x02 != 0 && params.Hours != 0 {
+				return 0, fmt.Errorf("a duration can't be given when deactivating vacation")
+			}
+			params.Hours = 0
+			flags |= 0x02
+		}
+	}
+
 	if config.MinTemperature != nil {
-		params.MinTemperature = *config.MinTemperature
+		if !validSetpoint(*config.MinTemperature, minHeatSetpoint, maxHeatSetpoint) {
+			return 0, fmt.Errorf("minTemperature must be between %d and %d degrees F",
+				minHeatSetpoint, maxHeatSetpoint)
+		}
+		params.MinTemperature = rawTemp(*config.MinTemperature)
 		flags |= 0x04
 	}
 
 	if config.MaxTemperature != nil {
-		params.MaxTemperature = *config.MaxTemperature
+		if !validSetpoint(*config.MaxTemperature, minCoolSetpoint, maxCoolSetpoint) {
+			return 0, fmt.Errorf("maxTemperature must be between %d and %d degrees F",
+				minCoolSetpoint, maxCoolSetpoint)
+		}
+		params.MaxTemperature = rawTemp(*config.MaxTemperature)
 		flags |= 0x08
 	}
 
+	if config.MinTemperature != nil && config.MaxTemperature != nil &&
+		params.MinTemperature >= params.MaxTemperature {
+		return 0, fmt.Errorf("minTemperature must be below maxTemperature")
+	}
+
 	if config.MinHumidity != nil {
+		if *config.MinHumidity < minVacationHumidity || *config.MinHumidity > maxVacationHumidity {
+			return 0, fmt.Errorf("minHumidity must be between %d and %d",
+				minVacationHumidity, maxVacationHumidity)
+		}
 		params.MinHumidity = *config.MinHumidity
 		flags |= 0x10
 	}
 
 	if config.MaxHumidity != nil {
+		if *config.MaxHumidity < minVacationHumidity || *config.MaxHumidity > maxVacationHumidity {
+			return 0, fmt.Errorf("maxHumidity must be between %d and %d",
+				minVacationHumidity, maxVacationHumidity)
+		}
 		params.MaxHumidity = *config.MaxHumidity
 		flags |= 0x20
 	}
 
+	if config.MinHumidity != nil && config.MaxHumidity != nil &&
+		*config.MinHumidity >= *config.MaxHumidity {
+		return 0, fmt.Errorf("minHumidity must be below maxHumidity")
+	}
+
 	if config.FanMode != nil {
-		mode, _ := stringFanModeToRaw(*config.FanMode)
-		// FIXME: check for ok here
+		mode, ok := stringFanModeToRaw(*config.FanMode)
+		if !ok {
+			return 0, fmt.Errorf("invalid fan mode: %s", *config.FanMode)
+		}
 		params.FanMode = mode
 		flags |= 0x40
 	}
 
-	return flags
+	return flags, nil
 }
 
 type TStatSettings struct {
@@ -189,3 +281,268 @@ type TStatSettings struct {
 func (params TStatSettings) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x3B, 0x06}
 }
+
+type APITStatSettings struct {
+	Backlight       *string  `json:"backlight"`
+	AutoMode        *bool    `json:"autoMode"`
+	DeadBand        *float64 `json:"deadBand"`
+	CyclesPerHour   *uint8   `json:"cyclesPerHour"`
+	SchedulePeriods *uint8   `json:"schedulePeriods"`
+	ProgramsEnabled *bool    `json:"programsEnabled"`
+	TempUnits       *string  `json:"tempUnits"`
+	DealerName      *string  `json:"dealerName"`
+	DealerPhone     *string  `json:"dealerPhone"`
+}
+
+// Limits for the writable numeric thermostat settings.
+const (
+	minDeadBand        = 2
+	maxDeadBand        = 6
+	minCyclesPerHour   = 2
+	maxCyclesPerHour   = 6
+	minSchedulePeriods = 1
+	maxSchedulePeriods = 5
+)
+
+// rawString converts a fixed length, NUL or space padded field to a string.
+func rawString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimRight(b, " "))
+}
+
+func (params TStatSettings) toAPI() APITStatSettings {
+	api := APITStatSettings{CyclesPerHour: &params.CyclesPerHour,
+		SchedulePeriods: &params.SchedulePeriods}
+
+	deadBand := float64(params.DeadBand)
+	api.DeadBand = &deadBand
+
+	backlight := rawBacklightToString(params.BacklightSetting)
+	api.Backlight = &backlight
+
+	autoMode := params.AutoMode == 1
+	api.AutoMode = &autoMode
+
+	programs := params.ProgramsEnabled == 1
+	api.ProgramsEnabled = &programs
+
+	units := rawTempUnitsToString(params.TempUnits)
+	api.TempUnits = &units
+
+	name := rawString(params.DealerName[:])
+	api.DealerName = &name
+
+	phone := rawString(params.DealerPhone[:])
+	api.DealerPhone = &phone
+
+	return api
+}
+
+func (api APITStatSettings) inUnits(u tempUnits) interface{} {
+	if api.DeadBand != nil {
+		d := u.deltaFromF(*api.DeadBand)
+		api.DeadBand = &d
+	}
+	return api
+}
+
+func (api *APITStatSettings) fromUnits(u tempUnits) {
+	if api.DeadBand != nil {
+		d := u.deltaToF(*api.DeadBand)
+		api.DeadBand = &d
+	}
+}
+
+// fromAPI copies the fields present in config into params and returns the
+// write flags covering them.  The dealer name and phone are read only.
+func (params *TStatSettings) fromAPI(config *APITStatSettings) (byte, error) {
+	flags := byte(0)
+
+	if config.Backlight != nil {
+		backlight, ok := stringBacklightToRaw(*config.Backlight)
+		if !ok {
+			return 0, fmt.Errorf("invalid backlight setting: %s", *config.Backlight)
+		}
+		params.BacklightSetting = backlight
+		flags |= 0x01
+	}
+
+	if config.AutoMode != nil {
+		if *config.AutoMode {
+			params.AutoMode = 1
+		} else {
+			params.AutoMode = 0
+		}
+		flags |= 0x02
+	}
+
+	if config.DeadBand != nil {
+		if !validSetpoint(*config.DeadBand, minDeadBand, maxDeadBand) {
+			return 0, fmt.Errorf("deadBand must be between %d and %d degrees F", minDeadBand, maxDeadBand)
+		}
+		params.DeadBand = rawTemp(*config.DeadBand)
+		flags |= 0x08
+	}
+
+	if config.CyclesPerHour != nil {
+		if *config.CyclesPerHour < minCyclesPerHour || *config.CyclesPerHour > maxCyclesPerHour {
+			return 0, fmt.Errorf("cyclesPerHour must be between %d and %d", minCyclesPerHour, maxCyclesPerHour)
+		}
+		params.CyclesPerHour = *config.CyclesPerHour
+		flags |= 0x10
+	}
+
+	if config.SchedulePeriods != nil {
+		if *config.SchedulePeriods < minSchedulePeriods || *config.SchedulePeriods > maxSchedulePeriods {
+			return 0, fmt.Errorf("schedulePeriods must be between %d and %d", minSchedulePeriods, maxSchedulePeriods)
+		}
+		params.SchedulePeriods = *config.SchedulePeriods
+		flags |= 0x20
+	}
+
+	if config.ProgramsEnabled != nil {
+		if *config.ProgramsEnabled {
+			params.ProgramsEnabled = 1
+		} else {
+			params.ProgramsEnabled = 0
+		}
+		flags |= 0x40
+	}
+
+	if config.TempUnits != nil {
+		units, ok := stringTempUnitsToRaw(*config.TempUnits)
+		if !ok {
+			return 0, fmt.Errorf("invalid temperature units: %s", *config.TempUnits)
+		}
+		params.TempUnits = units
+		flags |= 0x80
+	}
+
+	if config.DealerName != nil || config.DealerPhone != nil {
+		return 0, fmt.Errorf("dealerName and dealerPhone are read only")
+	}
+
+	return flags, nil
+}
+
+const (
+	scheduleDays    = 7
+	schedulePeriods = 5
+)
+
+type TStatSchedulePeriod struct {
+	StartTime    uint16 // minutes after midnight
+	HeatSetpoint uint8
+	CoolSetpoint uint8
+	FanMode      uint8 // matches fan mode from TStatZoneParams
+	Enabled      uint8
+}
+
+// Weekly program for a single zone, Sunday first.  Each zone has its own
+// table so there is no addr() method, use scheduleTableAddr instead.  Write
+// flags select days, 0x01 for Sunday through 0x40 for Saturday.
+type TStatZoneSchedule struct {
+	Days [scheduleDays][schedulePeriods]TStatSchedulePeriod
+}
+
+func scheduleTableAddr(zone int) InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3B, byte(0x10 + zone - 1)}
+}
+
+func (sched TStatZoneSchedule) mismatches(actual interface{}, flags uint8) []string {
+	a := actual.(*TStatZoneSchedule)
+	days := []string{}
+	for d := 0; d < scheduleDays; d++ {
+		if flags&(0x01<<d) != 0 && a.Days[d] != sched.Days[d] {
+			days = append(days, time.Weekday(d).String())
+		}
+	}
+	return days
+}
+
+// Thermostat clock.  Write flags follow field order, 0x3f writes everything.
+type TStatDateTime struct {
+	Hour      uint8
+	Minute    uint8
+	DayOfWeek uint8 // 0 is Sunday
+	Day       uint8
+	Month     uint8
+	Year      uint8 // years since 2000
+}
+
+func (params TStatDateTime) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x02, 0x02}
+}
+
+type FaultHistoryEntry struct {
+	Code   uint8
+	Count  uint8
+	Year   uint8 // years since 2000
+	Month  uint8
+	Day    uint8
+	Hour   uint8
+	Minute uint8
+}
+
+// Fault history kept by the thermostat, indoor and outdoor units, most
+// recent first.  Unused entries have a zero code.
+type FaultHistory struct {
+	Entries [10]FaultHistoryEntry
+}
+
+func (params FaultHistory) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x06, 0x02}
+}
+
+// Identification table answered by every device on the bus.  Strings are
+// space or NUL padded.
+type DeviceInfo struct {
+	DeviceType      [24]byte
+	SoftwareVersion [16]byte
+	ModelNumber     [20]byte
+	SerialNumber    [12]byte
+}
+
+func (params DeviceInfo) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x01, 0x04}
+}
+
+// Accessory configuration and status.  Only the ventilation level (flag
+// 0x01) and humidifier enable (flag 0x02) are writable.
+type TStatAccessories struct {
+	VentilationLevel   uint8
+	HumidifierEnabled  uint8
+	Installed          uint8 // bitflags: 0x01 ventilator, 0x02 humidifier, 0x04 UV lamp, 0x08 air purifier
+	Active             uint8 // bitflags, as Installed
+	VentilatorType     uint8
+	Unknown            uint8
+	VentilatorRuntime  uint16 // hours
+	HumidifierRuntime  uint16
+	UVLampRuntime      uint16
+	AirPurifierRuntime uint16
+	VentilatorLife     uint8 // percent remaining
+	HumidifierLife     uint8
+	UVLampLife         uint8
+	AirPurifierLife    uint8
+}
+
+func (params TStatAccessories) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3B, 0x0C}
+}
+
+// Service reminders.  Usage is the percentage of each service interval used
+// so far; writing zero with the matching flag resets it.  The reminder
+// bitflags are written with flag 0x10.
+type TStatMaintenance struct {
+	FilterUsage           uint8
+	UVLampUsage           uint8
+	HumidifierPadUsage    uint8
+	VentilatorFilterUsage uint8
+	Reminders             uint8 // bitflags: 0x01 filter, 0x02 UV lamp, 0x04 humidifier pad, 0x08 ventilator filter
+}
+
+func (params TStatMaintenance) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3B, 0x0D}
+}
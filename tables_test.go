@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestVacationFromAPI(t *testing.T) {
+	tests := []struct {
+		name   string
+		config APIVacationConfig
+		ok     bool
+	}{
+		{"days", APIVacationConfig{Days: ptr(uint8(3))}, true},
+		{"activate", APIVacationConfig{Active: ptr(true), Hours: ptr(uint16(12))}, true},
+		{"deactivate", APIVacationConfig{Active: ptr(false)}, true},
+		{"days and hours", APIVacationConfig{Days: ptr(uint8(1)), Hours: ptr(uint16(1))}, false},
+		{"activate without duration", APIVacationConfig{Active: ptr(true)}, false},
+		{"activate for zero days", APIVacationConfig{Active: ptr(true), Days: ptr(uint8(0))}, false},
+		{"deactivate with duration", APIVacationConfig{Active: ptr(false), Days: ptr(uint8(1))}, false},
+		{"longest", APIVacationConfig{Hours: ptr(uint16(maxVacationHours))}, true},
+		{"too long", APIVacationConfig{Hours: ptr(uint16(maxVacationHours + 1))}, false},
+		{"temperatures", APIVacationConfig{MinTemperature: ptr(60.0), MaxTemperature: ptr(85.0)}, true},
+		{"min too low", APIVacationConfig{MinTemperature: ptr(39.0)}, false},
+		{"min wraps", APIVacationConfig{MinTemperature: ptr(316.0)}, false},
+		{"max too high", APIVacationConfig{MaxTemperature: ptr(100.0)}, false},
+		{"min above max", APIVacationConfig{MinTemperature: ptr(80.0), MaxTemperature: ptr(70.0)}, false},
+		{"humidity", APIVacationConfig{MinHumidity: ptr(uint8(20)), MaxHumidity: ptr(uint8(60))}, true},
+		{"humidity too high", APIVacationConfig{MaxHumidity: ptr(uint8(96))}, false},
+		{"fan mode", APIVacationConfig{FanMode: ptr("low")}, true},
+		{"bad fan mode", APIVacationConfig{FanMode: ptr("turbo")}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := new(TStatVacationParams).fromAPI(&tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestVacationToAPIDays(t *testing.T) {
+	tests := []struct {
+		hours uint16
+		days  uint8
+	}{
+		{0, 0},
+		{1, 1},
+		{24, 1},
+		{25, 2},
+		{maxVacationHours, 255},
+		{0xffff, 255},
+	}
+
+	for _, tt := range tests {
+		api := TStatVacationParams{Hours: tt.hours}.toAPI()
+		if *api.Days != tt.days {
+			t.Errorf("%d hours: got %d days, want %d", tt.hours, *api.Days, tt.days)
+		}
+	}
+}
+
+func TestSettingsFromAPI(t *testing.T) {
+	tests := []struct {
+		name   string
+		config APITStatSettings
+		ok     bool
+	}{
+		{"deadband", APITStatSettings{DeadBand: ptr(3.0)}, true},
+		{"deadband too small", APITStatSettings{DeadBand: ptr(1.0)}, false},
+		{"deadband wraps", APITStatSettings{DeadBand: ptr(260.0)}, false},
+		{"deadband negative", APITStatSettings{DeadBand: ptr(-2.0)}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := new(TStatSettings).fromAPI(&tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// Temperatures are handled internally in Fahrenheit, which is what the
+// thermostat uses on the bus regardless of its display setting.  They are
+// converted to the caller's units when presented through the API or the
+// websocket and converted back to Fahrenheit when written.
+type tempUnits int
+
+const (
+	unitsF tempUnits = iota
+	unitsC
+)
+
+// unitsOverride is set from the command line.  When empty the default
+// follows the thermostat's TempUnits setting.
+var unitsOverride string
+
+// tstatUnits tracks the thermostat's TempUnits setting as last read.
+var tstatUnits atomic.Int32
+
+func parseUnits(s string) (tempUnits, bool) {
+	switch strings.ToUpper(s) {
+	case "F":
+		return unitsF, true
+	case "C":
+		return unitsC, true
+	default:
+		return unitsF, false
+	}
+}
+
+func (u tempUnits) String() string {
+	if u == unitsC {
+		return "C"
+	}
+	return "F"
+}
+
+func setTstatUnits(raw uint8) {
+	if raw == 1 {
+		tstatUnits.Store(int32(unitsC))
+	} else {
+		tstatUnits.Store(int32(unitsF))
+	}
+}
+
+// defaultUnits returns the units used when a request doesn't ask for any.
+func defaultUnits() tempUnits {
+	if u, ok := parseUnits(unitsOverride); ok {
+		return u
+	}
+	return tempUnits(tstatUnits.Load())
+}
+
+// requestUnits picks the units from a "units" query parameter or an
+// X-Temperature-Units header, falling back to the default.
+func requestUnits(query string, header string) (tempUnits, error) {
+	s := query
+	if len(s) == 0 {
+		s = header
+	}
+	if len(s) == 0 {
+		return defaultUnits(), nil
+	}
+
+	u, ok := parseUnits(s)
+	if !ok {
+		return unitsF, errors.New("units must be F or C")
+	}
+	return u, nil
+}
+
+func roundHalf(t float64) float64 {
+	return math.Round(t*2) / 2
+}
+
+// fromF converts a Fahrenheit temperature for presentation.  Celsius values
+// are rounded to the nearest half degree, as the thermostat displays them.
+func (u tempUnits) fromF(f float64) float64 {
+	if u == unitsC {
+		return roundHalf((f - 32) * 5 / 9)
+	}
+	return f
+}
+
+// optFromF converts a temperature that may be missing due to a sensor fault.
+func (u tempUnits) optFromF(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	t := u.fromF(*f)
+	return &t
+}
+
+// sensorFromF is like fromF but keeps a tenth of a degree of precision for
+// equipment sensors that report fractional temperatures.
+func (u tempUnits) sensorFromF(f float64) float64 {
+	if u == unitsC {
+		return math.Round((f-32)*5/9*10) / 10
+	}
+	return f
+}
+
+func (u tempUnits) optSensorFromF(f *float32) *float32 {
+	if f == nil {
+		return nil
+	}
+	t := float32(u.sensorFromF(float64(*f)))
+	return &t
+}
+
+// toF converts a temperature given in u to Fahrenheit.  Celsius values are
+// snapped to the nearest half degree first so that e.g. 21.4 and 21.5 both
+// select the same setpoint.
+func (u tempUnits) toF(t float64) float64 {
+	if u == unitsC {
+		return roundHalf(t)*9/5 + 32
+	}
+	return t
+}
+
+// deltaFromF and deltaToF convert temperature differences such as the
+// auto mode deadband.
+func (u tempUnits) deltaFromF(f float64) float64 {
+	if u == unitsC {
+		return roundHalf(f * 5 / 9)
+	}
+	return f
+}
+
+func (u tempUnits) deltaToF(t float64) float64 {
+	if u == unitsC {
+		return roundHalf(t) * 9 / 5
+	}
+	return t
+}
+
+// rawTemp rounds a Fahrenheit temperature to the whole degree stored by the
+// thermostat.  Values outside what a byte holds are clamped rather than
+// wrapped; callers range check with validSetpoint first.
+func rawTemp(f float64) uint8 {
+	r := math.Round(f)
+	if r < 0 || math.IsNaN(r) {
+		return 0
+	}
+	if r > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(r)
+}
+
+// validSetpoint checks a Fahrenheit temperature against a range before it
+// is rounded with rawTemp.
+func validSetpoint(f float64, min uint8, max uint8) bool {
+	r := math.Round(f)
+	return r >= float64(min) && r <= float64(max)
+}
+
+// unitConverter is implemented by API types carrying temperatures.
+type unitConverter interface {
+	inUnits(u tempUnits) interface{}
+}
+
+func convertUnits(data interface{}, u tempUnits) interface{} {
+	if c, ok := data.(unitConverter); ok {
+		return c.inUnits(u)
+	}
+	return data
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestSetpointRoundTrip(t *testing.T) {
+	for f := uint8(minHeatSetpoint); f <= maxCoolSetpoint; f++ {
+		c := unitsC.fromF(float64(f))
+		if got := rawTemp(unitsC.toF(c)); got != f {
+			t.Errorf("%d F -> %.1f C -> %d F", f, c, got)
+		}
+		if got := rawTemp(unitsF.toF(unitsF.fromF(float64(f)))); got != f {
+			t.Errorf("%d F -> %d F", f, got)
+		}
+	}
+}
+
+func TestRawTemp(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want uint8
+	}{
+		{70, 70},
+		{70.4, 70},
+		{70.5, 71},
+		{-5, 0},
+		{260, 255},
+	}
+
+	for _, tt := range tests {
+		if got := rawTemp(tt.f); got != tt.want {
+			t.Errorf("rawTemp(%v) = %d, want %d", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestValidSetpoint(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want bool
+	}{
+		{40, true},
+		{39.6, true},
+		{39.4, false},
+		{90, true},
+		{90.4, true},
+		{90.5, false},
+		{296, false},
+		{-216, false},
+	}
+
+	for _, tt := range tests {
+		if got := validSetpoint(tt.f, minHeatSetpoint, maxHeatSetpoint); got != tt.want {
+			t.Errorf("validSetpoint(%v) = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A planned vacation is enabled by infinitive at its start time with the
+// settings given when it was planned and disabled again at its end time.
+// Plans are kept in memory only.
+type vacationPlan struct {
+	start    time.Time
+	end      time.Time
+	settings APIVacationConfig
+	started  bool
+}
+
+var (
+	plannedVacation *vacationPlan
+	vacationMutex   = &sync.Mutex{}
+)
+
+// vacationHours returns the whole number of hours until end, rounded up.
+func vacationHours(now time.Time, end time.Time) uint16 {
+	h := (end.Sub(now) + time.Hour - time.Second) / time.Hour
+	if h < 0 {
+		return 0
+	}
+	if h > maxVacationHours {
+		return maxVacationHours
+	}
+	return uint16(h)
+}
+
+func getVacation() (*APIVacationConfig, bool) {
+	vac := TStatVacationParams{}
+	ok := infinity.ReadTable(devTSTAT, &vac)
+	if !ok {
+		return nil, false
+	}
+
+	api := vac.toAPI()
+
+	vacationMutex.Lock()
+	if plannedVacation != nil {
+		start := plannedVacation.start.Format(time.RFC3339)
+		end := plannedVacation.end.Format(time.RFC3339)
+		api.Start = &start
+		api.End = &end
+	}
+	vacationMutex.Unlock()
+
+	return &api, true
+}
+
+func writeVacation(config *APIVacationConfig) (bool, error) {
+	params := TStatVacationParams{}
+	flags, err := params.fromAPI(config)
+	if err != nil {
+		return false, err
+	}
+	if flags == 0 {
+		return true, nil
+	}
+	return writeTable(devTSTAT, params, flags)
+}
+
+// putVacation applies a vacation update.  With an end time the vacation is
+// planned: it starts now, or at the start time if that is in the future,
+// and lasts until the end.  Without one the update is written immediately
+// and any plan is cancelled if the duration changes.
+func putVacation(config *APIVacationConfig) (bool, error) {
+	if config.Start == nil && config.End == nil {
+		// validate before touching the plan
+		if _, err := new(TStatVacationParams).fromAPI(config); err != nil {
+			return false, err
+		}
+		if config.Days != nil || config.Hours != nil || config.Active != nil {
+			vacationMutex.Lock()
+			plannedVacation = nil
+			vacationMutex.Unlock()
+		}
+		return writeVacation(config)
+	}
+
+	if config.End == nil {
+		return false, errors.New("end is required with start")
+	}
+	if config.Days != nil || config.Hours != nil || config.Active != nil {
+		return false, errors.New("days, hours and active can't be combined with start and end")
+	}
+
+	now := time.Now()
+	start := now
+	if config.Start != nil {
+		t, err := time.Parse(time.RFC3339, *config.Start)
+		if err != nil {
+			return false, errors.New("start must be an RFC 3339 time")
+		}
+		if t.After(now) {
+			start = t
+		}
+	}
+
+	end, err := time.Parse(time.RFC3339, *config.End)
+	if err != nil {
+		return false, errors.New("end must be an RFC 3339 time")
+	}
+	if !end.After(start) {
+		return false, errors.New("end must be after start and in the future")
+	}
+	if end.Sub(start) > maxVacationHours*time.Hour {
+		return false, fmt.Errorf("end must be within %d days of start", maxVacationHours/24)
+	}
+
+	plan := &vacationPlan{start: start, end: end, settings: *config}
+	plan.settings.Start = nil
+	plan.settings.End = nil
+
+	// validate the settings now rather than when the plan starts
+	if _, err := new(TStatVacationParams).fromAPI(&plan.settings); err != nil {
+		return false, err
+	}
+
+	vacationMutex.Lock()
+	plannedVacation = plan
+	vacationMutex.Unlock()
+
+	log.Infof("vacation planned from %s to %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	return checkVacationPlan(now), nil
+}
+
+// checkVacationPlan starts or ends the planned vacation when due.  It
+// returns false if a write to the thermostat failed.
+func checkVacationPlan(now time.Time) bool {
+	vacationMutex.Lock()
+	defer vacationMutex.Unlock()
+
+	plan := plannedVacation
+	if plan == nil {
+		return true
+	}
+
+	if !now.Before(plan.end) {
+		log.Info("planned vacation ended")
+		off := false
+		ok, _ := writeVacation(&APIVacationConfig{Active: &off})
+		if ok {
+			plannedVacation = nil
+		}
+		return ok
+	}
+
+	if !plan.started && !now.Before(plan.start) {
+		log.Info("planned vacation started")
+		settings := plan.settings
+		hours := vacationHours(now, plan.end)
+		settings.Hours = &hours
+		ok, _ := writeVacation(&settings)
+		plan.started = ok
+		return ok
+	}
+
+	return true
+}
+
+func vacationPlanner() {
+	for {
+		time.Sleep(time.Minute)
+		checkVacationPlan(time.Now())
+	}
+}
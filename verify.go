@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// verifyWrites enables reading tables back after writing them to check the
+// write took effect.  Set from the command line.
+var verifyWrites bool
+
+// number of times a write that didn't take effect is repeated
+const verifyRetries = 2
+
+// writeMismatchError reports a write the device acknowledged but didn't
+// apply.
+type writeMismatchError struct {
+	dst    uint16
+	addr   InfinityTableAddr
+	fields []string
+}
+
+func (e *writeMismatchError) Error() string {
+	return fmt.Sprintf("write to table %x on %04x was not applied: %s differs after writing",
+		e.addr[:], e.dst, strings.Join(e.fields, ", "))
+}
+
+// writeChecker is implemented by tables whose write flags don't select
+// their fields in order.
+type writeChecker interface {
+	mismatches(actual interface{}, flags uint8) []string
+}
+
+// mismatches lists the fields selected by flags that differ between the
+// written and read back values.  Bit n of the flags selects the nth field.
+func mismatches(written interface{}, actual interface{}, flags uint8) []string {
+	if c, ok := written.(writeChecker); ok {
+		return c.mismatches(actual, flags)
+	}
+
+	w := reflect.Indirect(reflect.ValueOf(written))
+	a := reflect.Indirect(reflect.ValueOf(actual))
+
+	fields := []string{}
+	for i := 0; i < 8 && i < w.NumField(); i++ {
+		if flags&(0x01<<i) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(w.Field(i).Interface(), a.Field(i).Interface()) {
+			fields = append(fields, w.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
+
+// writeTable writes a table, verifying it if enabled.
+func writeTable(dst uint16, table InfinityTable, flags uint8) (bool, error) {
+	return writeTableAt(dst, table.addr(), flags, table)
+}
+
+// writeTableAt writes params to the table at addr.  With -verify-writes the
+// table is read back and the fields selected by flags compared, repeating
+// the write if they don't match.  A write that still doesn't match returns
+// a writeMismatchError.
+func writeTableAt(dst uint16, addr InfinityTableAddr, flags uint8, params interface{}) (bool, error) {
+	for tries := 0; ; tries++ {
+		if !infinity.Write(dst, addr[:], []byte{0x00, 0x00, flags}, params) {
+			return false, nil
+		}
+		if !verifyWrites {
+			return true, nil
+		}
+
+		actual := reflect.New(reflect.Indirect(reflect.ValueOf(params)).Type())
+		if !infinity.Read(dst, addr, actual.Interface()) {
+			return false, nil
+		}
+
+		fields := mismatches(params, actual.Interface(), flags)
+		if len(fields) == 0 {
+			return true, nil
+		}
+
+		err := &writeMismatchError{dst: dst, addr: addr, fields: fields}
+		if tries == verifyRetries {
+			log.Error(err.Error())
+			return false, err
+		}
+		log.Warnf("%s, retrying", err.Error())
+	}
+}
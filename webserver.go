@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 
 	"golang.org/x/net/websocket"
 
@@ -21,279 +23,490 @@ func handleErrors(c *gin.Context) {
 	}
 }
 
+// handleUnits resolves the temperature units requested by the client so
+// handlers can fetch them with units().
+func handleUnits(c *gin.Context) {
+	u, err := requestUnits(c.Query("units"), c.GetHeader("X-Temperature-Units"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	c.Set("units", u)
+}
+
+func units(c *gin.Context) tempUnits {
+	if u, ok := c.Get("units"); ok {
+		return u.(tempUnits)
+	}
+	return defaultUnits()
+}
+
 func webserver(port int) {
 	r := gin.Default()
 	r.Use(handleErrors) // attach error handling middleware
 
 	api := r.Group("/api")
+	api.Use(handleUnits)
 
 	api.GET("/tstat/settings", func(c *gin.Context) {
-		tss, ok := getTstatSettings()
-		if ok {
-			c.JSON(200, tss)
+		maxAge, ok := maxAgeParam(c, "settings")
+		if !ok {
+			return
 		}
-	})
 
-	api.GET("/zone/0/config", func(c *gin.Context) {
-		cfgZ0, ok := getZ0Config()
+		tss, ok := cachedSettings(maxAge)
 		if ok {
-			c.JSON(200, cfgZ0)
+			stateHeaders(c, getSectionMeta(state, &state.settings))
+			c.JSON(200, convertUnits(tss, units(c)))
+		} else {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
 		}
 	})
 
-	api.GET("/zone/1/config", func(c *gin.Context) {
-		cfgZ1, ok := getZ1Config()
+	api.PUT("/tstat/settings", func(c *gin.Context) {
+		var args APITStatSettings
+
+		if c.Bind(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
+
+		args.fromUnits(units(c))
+
+		params := TStatSettings{}
+		flags, err := params.fromAPI(&args)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+
+		if flags != 0 {
+			ok, err := writeTable(devTSTAT, params, flags)
+			if err != nil {
+				abortWriteError(c, err)
+				return
+			}
+			if !ok {
+				c.AbortWithError(504, errors.New("timed out waiting for response"))
+				return
+			}
+		}
+
+		// read directly rather than joining a read that may have started
+		// before the write
+		tss, ok := getTstatSettings(priorityRead)
 		if ok {
-			c.JSON(200, cfgZ1)
+			setSection(state, &state.settings, *tss, sourcePolled)
+			c.JSON(200, convertUnits(tss, units(c)))
 		}
 	})
 
-	api.GET("/zone/2/config", func(c *gin.Context) {
-		cfgZ2, ok := getZ2Config()
+	api.GET("/tstat/time", func(c *gin.Context) {
+		tt, ok := getTstatTime(priorityRead)
 		if ok {
-			c.JSON(200, cfgZ2)
+			c.JSON(200, tt)
 		}
 	})
 
-	api.GET("/zone/3/config", func(c *gin.Context) {
-		cfgZ3, ok := getZ3Config()
+	api.PUT("/tstat/time", func(c *gin.Context) {
+		if !setTstatTime() {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
+
+		tt, ok := getTstatTime(priorityRead)
 		if ok {
-			c.JSON(200, cfgZ3)
+			c.JSON(200, tt)
 		}
 	})
 
-	api.GET("/zone/4/config", func(c *gin.Context) {
-		cfgZ4, ok := getZ4Config()
-		if ok {
-			c.JSON(200, cfgZ4)
+	api.GET("/tstat/modes", func(c *gin.Context) {
+		c.JSON(200, gin.H{"modes": validModes()})
+	})
+
+	api.GET("/zone/:zone/config", func(c *gin.Context) {
+		zone := 0
+		if c.Param("zone") != "0" {
+			z, ok := zoneParam(c)
+			if !ok {
+				return
+			}
+			zone = z
+		}
+
+		maxAge, ok := maxAgeParam(c, "zones")
+		if !ok {
+			return
+		}
+
+		t, ok := cachedZoneTables(maxAge)
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
+
+		stateHeaders(c, getSectionMeta(state, &state.zones))
+		if zone == 0 {
+			c.JSON(200, convertUnits(t.zone0Config(), units(c)))
+		} else {
+			c.JSON(200, convertUnits(t.zoneConfig(zone), units(c)))
 		}
 	})
 
-	api.GET("/zone/1/airhandler", func(c *gin.Context) {
-		ah, ok := getAirHandler()
+	api.GET("/zone/:zone/schedule", func(c *gin.Context) {
+		zone, ok := zoneParam(c)
+		if !ok {
+			return
+		}
+
+		maxAge, ok := maxAgeParam(c, "schedule")
+		if !ok {
+			return
+		}
+
+		all, ok := cachedSchedule(maxAge)
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
+
+		// only configured zones are polled, others are read directly
+		sched, cached := all.Zones[strconv.Itoa(zone)]
+		if cached {
+			stateHeaders(c, getSectionMeta(state, &state.schedule))
+			c.JSON(200, convertUnits(sched, units(c)))
+			return
+		}
+
+		s, ok := getZoneSchedule(zone, priorityRead)
 		if ok {
-			c.JSON(200, ah)
+			c.JSON(200, convertUnits(s, units(c)))
+		} else {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
 		}
 	})
 
-	api.GET("/zone/1/heatpump", func(c *gin.Context) {
-		hp, ok := getHeatPump()
+	api.PUT("/zone/:zone/schedule", func(c *gin.Context) {
+		zone, ok := zoneParam(c)
+		if !ok {
+			return
+		}
+
+		var args APIZoneSchedule
+
+		if c.Bind(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
+
+		args.fromUnits(units(c))
+
+		ok, err := putZoneSchedule(zone, &args)
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
+
+		sched, ok := getZoneSchedule(zone, priorityRead)
 		if ok {
-			c.JSON(200, hp)
+			c.JSON(200, convertUnits(sched, units(c)))
 		}
 	})
 
-	api.GET("/zone/1/vacation", func(c *gin.Context) {
-		vac := TStatVacationParams{}
-		ok := infinity.ReadTable(devTSTAT, &vac)
+	api.GET("/schedule", func(c *gin.Context) {
+		maxAge, ok := maxAgeParam(c, "schedule")
+		if !ok {
+			return
+		}
+
+		sched, ok := cachedSchedule(maxAge)
 		if ok {
-			c.JSON(200, vac.toAPI())
+			stateHeaders(c, getSectionMeta(state, &state.schedule))
+			c.JSON(200, convertUnits(sched, units(c)))
+		} else {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
 		}
 	})
 
-	api.PUT("/zone/1/vacation", func(c *gin.Context) {
-		var args APIVacationConfig
+	api.PUT("/schedule", func(c *gin.Context) {
+		var args APISchedule
 
 		if c.Bind(&args) != nil {
 			log.Printf("bind failed")
 			return
 		}
 
-		params := TStatVacationParams{}
-		flags := params.fromAPI(&args)
+		args.fromUnits(units(c))
 
-		infinity.WriteTable(devTSTAT, params, flags)
+		ok, err := putSchedule(&args)
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
 
+		sched, ok := getSchedule(priorityRead)
+		if ok {
+			c.JSON(200, convertUnits(sched, units(c)))
+		}
 	})
 
-	api.PUT("/zone/1/config", func(c *gin.Context) {
-		var args TStatZone0Config
+	api.GET("/dampers", func(c *gin.Context) {
+		d, ok := getDampers()
+		if ok {
+			stateHeaders(c, getSectionMeta(state, &state.dampers))
+			c.JSON(200, d)
+		} else {
+			c.AbortWithError(404, errors.New("no damper control module has been seen"))
+		}
+	})
 
-		if c.Bind(&args) == nil {
-			params := TStatZoneParams{}
-			flags := byte(0)
+	getAirHandlerHandler := func(c *gin.Context) {
+		ah, ok := getAirHandler()
+		if ok {
+			stateHeaders(c, getSectionMeta(state, &state.airHandler))
+			c.JSON(200, ah)
+		}
+	}
 
-			if len(args.FanModeZ1) > 0 {
-				mode, _ := stringFanModeToRaw(args.FanModeZ1)
-				// FIXME: check for ok here
-				params.Z1FanMode = mode
-				flags |= 0x01
-			}
+	api.GET("/airhandler", getAirHandlerHandler)
+	api.GET("/zone/1/airhandler", getAirHandlerHandler)
 
-			if args.Hold != nil {
-				if *args.Hold {
-					params.ZoneHold = 0x01
-				} else {
-					params.ZoneHold = 0x00
-				}
-				flags |= 0x02
-			}
+	getHeatPumpHandler := func(c *gin.Context) {
+		hp, ok := getHeatPump()
+		if ok {
+			stateHeaders(c, getSectionMeta(state, &state.heatPump))
+			c.JSON(200, convertUnits(hp, units(c)))
+		}
+	}
 
-			if args.HeatSetpointZ1 > 0 {
-				params.Z1HeatSetpoint = args.HeatSetpointZ1
-				flags |= 0x04
-			}
+	api.GET("/heatpump", getHeatPumpHandler)
+	api.GET("/zone/1/heatpump", getHeatPumpHandler)
 
-			if args.CoolSetpointZ1 > 0 {
-				params.Z1CoolSetpoint = args.CoolSetpointZ1
-				flags |= 0x08
-			}
+	getVacationHandler := func(c *gin.Context) {
+		vac, ok := getVacation()
+		if ok {
+			c.JSON(200, convertUnits(vac, units(c)))
+		}
+	}
 
-			if flags != 0 {
-				log.Printf("calling doWrite with flags: %x", flags)
-				infinity.WriteTable(devTSTAT, params, flags)
-			}
+	putVacationHandler := func(c *gin.Context) {
+		var args APIVacationConfig
 
-			if len(args.Mode) > 0 {
-				p := TStatCurrentParams{Mode: stringModeToRaw(args.Mode)}
-				infinity.WriteTable(devTSTAT, p, 0x10)
-			}
-		} else {
+		if c.Bind(&args) != nil {
 			log.Printf("bind failed")
+			return
 		}
-	})
 
-	api.PUT("/zone/2/config", func(c *gin.Context) {
-		var args TStatZone0Config
+		args.fromUnits(units(c))
 
-		if c.Bind(&args) == nil {
-			params := TStatZoneParams{}
-			flags := byte(0)
+		ok, err := putVacation(&args)
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
 
-			if len(args.FanModeZ2) > 0 {
-				mode, _ := stringFanModeToRaw(args.FanModeZ2)
-				// FIXME: check for ok here
-				params.Z2FanMode = mode
-				flags |= 0x01
-			}
+		getVacationHandler(c)
+	}
 
-			if args.Hold != nil {
-				if *args.Hold {
-					params.ZoneHold = 0x01
-				} else {
-					params.ZoneHold = 0x00
-				}
-				flags |= 0x02
-			}
+	api.GET("/vacation", getVacationHandler)
+	api.PUT("/vacation", putVacationHandler)
 
-			if args.HeatSetpointZ2 > 0 {
-				params.Z2HeatSetpoint = args.HeatSetpointZ2
-				flags |= 0x04
-			}
+	// vacation is system wide, kept for compatibility
+	api.GET("/zone/1/vacation", getVacationHandler)
+	api.PUT("/zone/1/vacation", putVacationHandler)
 
-			if args.CoolSetpointZ2 > 0 {
-				params.Z2CoolSetpoint = args.CoolSetpointZ2
-				flags |= 0x08
-			}
+	api.PUT("/zone/:zone/config", func(c *gin.Context) {
+		zone, ok := zoneParam(c)
+		if !ok {
+			return
+		}
 
-			if flags != 0 {
-				log.Printf("calling doWrite with flags: %x", flags)
-				infinity.WriteTable(devTSTAT, params, flags)
-			}
+		var args TStatZoneConfig
 
-			if len(args.Mode) > 0 {
-				p := TStatCurrentParams{Mode: stringModeToRaw(args.Mode)}
-				infinity.WriteTable(devTSTAT, p, 0x10)
-			}
-		} else {
+		if c.Bind(&args) != nil {
 			log.Printf("bind failed")
+			return
+		}
+
+		args.fromUnits(units(c))
+
+		if err := validateZoneConfig(&args); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+
+		ok, err := putZoneConfig(zone, &args)
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
+
+		t, ok := readZoneTables(priorityRead)
+		if ok {
+			c.JSON(200, convertUnits(t.zoneConfig(zone), units(c)))
 		}
 	})
 
-	api.PUT("/zone/3/config", func(c *gin.Context) {
-		var args TStatZone0Config
+	api.GET("/accessories", func(c *gin.Context) {
+		acc, ok := getAccessories()
+		if ok {
+			c.JSON(200, acc)
+		}
+	})
 
-		if c.Bind(&args) == nil {
-			params := TStatZoneParams{}
-			flags := byte(0)
+	api.PUT("/accessories", func(c *gin.Context) {
+		var args APIAccessoriesUpdate
 
-			if len(args.FanModeZ3) > 0 {
-				mode, _ := stringFanModeToRaw(args.FanModeZ3)
-				// FIXME: check for ok here
-				params.Z3FanMode = mode
-				flags |= 0x01
-			}
+		if c.Bind(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
 
-			if args.Hold != nil {
-				if *args.Hold {
-					params.ZoneHold = 0x01
-				} else {
-					params.ZoneHold = 0x00
-				}
-				flags |= 0x02
-			}
+		ok, err := putAccessories(&args)
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
 
-			if args.HeatSetpointZ3 > 0 {
-				params.Z3HeatSetpoint = args.HeatSetpointZ3
-				flags |= 0x04
-			}
+		acc, ok := getAccessories()
+		if ok {
+			c.JSON(200, acc)
+		}
+	})
 
-			if args.CoolSetpointZ3 > 0 {
-				params.Z3CoolSetpoint = args.CoolSetpointZ3
-				flags |= 0x08
-			}
+	api.GET("/maintenance", func(c *gin.Context) {
+		m, ok := getMaintenance()
+		if ok {
+			c.JSON(200, m)
+		}
+	})
 
-			if flags != 0 {
-				log.Printf("calling doWrite with flags: %x", flags)
-				infinity.WriteTable(devTSTAT, params, flags)
-			}
+	api.POST("/maintenance/:item/reset", func(c *gin.Context) {
+		ok, err := resetMaintenance(c.Param("item"))
+		if err != nil {
+			abortWriteError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+			return
+		}
 
-			if len(args.Mode) > 0 {
-				p := TStatCurrentParams{Mode: stringModeToRaw(args.Mode)}
-				infinity.WriteTable(devTSTAT, p, 0x10)
-			}
+		m, ok := getMaintenance()
+		if ok {
+			c.JSON(200, m)
+		}
+	})
+
+	api.GET("/faults", func(c *gin.Context) {
+		faults, ok := getFaults()
+		if ok {
+			c.JSON(200, faults)
 		} else {
-			log.Printf("bind failed")
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
 		}
 	})
 
-	api.PUT("/zone/4/config", func(c *gin.Context) {
-		var args TStatZone0Config
+	api.GET("/devices", func(c *gin.Context) {
+		c.JSON(200, getDevices())
+	})
 
-		if c.Bind(&args) == nil {
-			params := TStatZoneParams{}
-			flags := byte(0)
+	api.GET("/devices/:addr/info", func(c *gin.Context) {
+		matched, _ := regexp.MatchString("^[a-f0-9]{4}$", c.Param("addr"))
+		if !matched {
+			c.AbortWithError(400, errors.New("addr must be a 4 character hex string"))
+			return
+		}
 
-			if len(args.FanModeZ4) > 0 {
-				mode, _ := stringFanModeToRaw(args.FanModeZ4)
-				// FIXME: check for ok here
-				params.Z4FanMode = mode
-				flags |= 0x01
-			}
+		addr, _ := strconv.ParseUint(c.Param("addr"), 16, 16)
+		if !deviceDiscovered(uint16(addr)) {
+			c.AbortWithError(404, errors.New("device has not been seen on the bus"))
+			return
+		}
 
-			if args.Hold != nil {
-				if *args.Hold {
-					params.ZoneHold = 0x01
-				} else {
-					params.ZoneHold = 0x00
-				}
-				flags |= 0x02
-			}
+		info, ok := getDeviceInfo(uint16(addr), priorityRead)
+		if ok {
+			c.JSON(200, info)
+		} else {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+		}
+	})
 
-			if args.HeatSetpointZ4 > 0 {
-				params.Z4HeatSetpoint = args.HeatSetpointZ4
-				flags |= 0x04
-			}
+	api.GET("/sensors", func(c *gin.Context) {
+		maxAge, ok := maxAgeParam(c, "zones")
+		if !ok {
+			return
+		}
 
-			if args.CoolSetpointZ4 > 0 {
-				params.Z4CoolSetpoint = args.CoolSetpointZ4
-				flags |= 0x08
-			}
+		readings, ok := getRemoteSensorReadings(maxAge)
+		if ok {
+			c.JSON(200, convertUnits(readings, units(c)))
+		} else {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+		}
+	})
 
-			if flags != 0 {
-				log.Printf("calling doWrite with flags: %x", flags)
-				infinity.WriteTable(devTSTAT, params, flags)
-			}
+	api.GET("/sensors/:addr", func(c *gin.Context) {
+		matched, _ := regexp.MatchString("^[a-f0-9]{4}$", c.Param("addr"))
+		if !matched {
+			c.AbortWithError(400, errors.New("addr must be a 4 character hex string"))
+			return
+		}
 
-			if len(args.Mode) > 0 {
-				p := TStatCurrentParams{Mode: stringModeToRaw(args.Mode)}
-				infinity.WriteTable(devTSTAT, p, 0x10)
-			}
+		maxAge, ok := maxAgeParam(c, "zones")
+		if !ok {
+			return
+		}
+
+		addr, _ := strconv.ParseUint(c.Param("addr"), 16, 16)
+		reading, ok := getRemoteSensorReading(uint16(addr), maxAge)
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out waiting for response"))
+		} else if reading == nil {
+			c.AbortWithError(404, errors.New("no readings from this sensor"))
 		} else {
-			log.Printf("bind failed")
+			c.JSON(200, convertUnits(reading, units(c)))
+		}
+	})
+
+	api.GET("/sam", func(c *gin.Context) {
+		tables, ok := getSAMTables()
+		if ok {
+			stateHeaders(c, getSectionMeta(state, &state.sam))
+			c.JSON(200, convertUnits(tables, units(c)))
+		} else {
+			c.AbortWithError(404, errors.New("the thermostat hasn't written to the SAM"))
 		}
 	})
 
+	api.GET("/diagnostics", func(c *gin.Context) {
+		c.JSON(200, gin.H{"bus": infinity.Diagnostics()})
+	})
+
+	api.GET("/state", func(c *gin.Context) {
+		c.JSON(200, convertUnits(state.snapshot(), units(c)))
+	})
+
 	api.GET("/raw/:device/:table", func(c *gin.Context) {
 		matched, _ := regexp.MatchString("^[a-f0-9]{4}$", c.Param("device"))
 		if !matched {
@@ -336,8 +549,75 @@ func webserver(port int) {
 	r.Run(":" + strconv.Itoa(port)) // listen and server on 0.0.0.0:8080
 }
 
+// zoneParam parses the :zone route parameter, aborting the request with a
+// 400 if it isn't a valid zone number.
+func zoneParam(c *gin.Context) (int, bool) {
+	zone, err := strconv.Atoi(c.Param("zone"))
+	if err != nil || zone < 1 || zone > maxZones {
+		c.AbortWithError(400, fmt.Errorf("zone must be between 1 and %d", maxZones))
+		return 0, false
+	}
+	return zone, true
+}
+
+// abortWriteError fails a request whose write was rejected: a 409 if the
+// thermostat didn't apply it, otherwise a 400 for invalid input.
+func abortWriteError(c *gin.Context, err error) {
+	var mismatch *writeMismatchError
+	if errors.As(err, &mismatch) {
+		c.AbortWithError(409, err)
+	} else {
+		c.AbortWithError(400, err)
+	}
+}
+
+// maxAgeParam returns how old cached data may be to answer the request.
+// A "fresh=true" query forces a bus read and "maxAge" sets the age, either
+// as a duration such as "30s" or in seconds.  Otherwise any data that isn't
+// stale is used.
+func maxAgeParam(c *gin.Context, section string) (time.Duration, bool) {
+	if fresh, _ := strconv.ParseBool(c.Query("fresh")); fresh {
+		return 0, true
+	}
+
+	s := c.Query("maxAge")
+	if len(s) == 0 {
+		return defaultMaxAge(section), true
+	}
+
+	maxAge, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.ParseUint(s, 10, 32)
+		if serr != nil {
+			c.AbortWithError(400, errors.New("maxAge must be a duration or a number of seconds"))
+			return 0, false
+		}
+		maxAge = time.Duration(secs) * time.Second
+	}
+	if maxAge < 0 {
+		c.AbortWithError(400, errors.New("maxAge must not be negative"))
+		return 0, false
+	}
+	return maxAge, true
+}
+
+// stateHeaders describes the freshness of cached data served by a request.
+func stateHeaders(c *gin.Context, meta APISectionMeta) {
+	if meta.LastUpdated != nil {
+		c.Header("Last-Modified", meta.LastUpdated.UTC().Format(http.TimeFormat))
+		c.Header("X-Data-Source", string(meta.Source))
+	}
+	c.Header("X-Data-Stale", strconv.FormatBool(meta.Stale))
+}
+
 func attachListener(ws *websocket.Conn) {
-	listener := &EventListener{make(chan []byte, 32)}
+	req := ws.Request()
+	u, err := requestUnits(req.URL.Query().Get("units"), req.Header.Get("X-Temperature-Units"))
+	if err != nil {
+		u = defaultUnits()
+	}
+
+	listener := &EventListener{ch: make(chan []byte, 32), units: u}
 
 	defer func() {
 		Dispatcher.deregister <- listener
@@ -350,10 +630,10 @@ func attachListener(ws *websocket.Conn) {
 
 	Dispatcher.register <- listener
 
-	// log.Printf("dumping cached data")
-	for source, data := range cache {
-		// log.Printf("dumping %s", source)
-		ws.Write(serializeEvent(source, data))
+	// log.Printf("dumping current state")
+	for _, event := range state.snapshot().events() {
+		// log.Printf("dumping %s", event.Source)
+		ws.Write(serializeEvent(event.Source, convertUnits(event.Data, listener.units)))
 	}
 
 	// wait for events